@@ -6,7 +6,7 @@ export const App: Component = () => {
 			<h1>App for SL time table</h1>
 			<button
 				onClick={() => {
-					fetch("/api/sites?term=sundbyberg")
+					fetch("/api/v1/sites?term=sundbyberg")
 						.then((r) => r.json())
 						.then(console.log);
 				}}
@@ -3,15 +3,32 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	gosltimetable "github.com/alexdriaguine/go-sl-time-table/internal"
+	"github.com/alexdriaguine/go-sl-time-table/internal/sitestore"
 	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
 )
 
 func main() {
 	port := ":3000"
 
-	slClient := sl_api.NewDefaultSLApi()
+	sitesDb := os.Getenv("SITES_DB")
+	if sitesDb == "" {
+		sitesDb = "sites.db"
+	}
+
+	// without the store we get the sites from sl at start, like before
+	var opts []sl_api.Option
+	if store, err := sitestore.Open(sitesDb); err != nil {
+		log.Printf("running without a site store, %v", err)
+	} else {
+		defer store.Close()
+		opts = append(opts, sl_api.WithSiteStore(store))
+	}
+
+	slClient := sl_api.NewDefaultSLApi(opts...)
+	defer slClient.Close()
 	router, err := gosltimetable.NewRouter(slClient)
 
 	if err != nil {
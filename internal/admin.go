@@ -0,0 +1,111 @@
+package gosltimetable
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache"
+)
+
+type CacheInfo struct {
+	Name string
+	Len  int
+	Keys []string `json:",omitempty"`
+}
+
+type DeleteCacheResponse struct {
+	Deleted int
+}
+
+// registerAdmin adds the cache admin endpoints, they're only enabled
+// when a token is set since they can wipe every cache we have
+func (router *Router) registerAdmin(handler *http.ServeMux, token string) {
+	if token == "" {
+		return
+	}
+
+	handler.Handle("GET /api/admin/caches", router.requireToken(token, router.handleListCaches))
+	handler.Handle("GET /api/admin/caches/{name}", router.requireToken(token, router.handleGetCache))
+	handler.Handle("DELETE /api/admin/caches/{name}", router.requireToken(token, router.handleDeleteCache))
+}
+
+func (router *Router) requireToken(token string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, _ := strings.CutPrefix(r.Header.Get("authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, r, newProblem(http.StatusUnauthorized, "unauthorized", "A valid admin token is needed"))
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// caches from the sl client together with our own last known departures
+func (router *Router) caches() map[string]cache.Admin {
+	caches := map[string]cache.Admin{}
+	maps.Copy(caches, router.slClient.Caches())
+	caches["stale-departures"] = router.lastDepartures
+	return caches
+}
+
+func (router *Router) handleListCaches(w http.ResponseWriter, r *http.Request) {
+	caches := router.caches()
+	infos := []CacheInfo{}
+	for _, name := range slices.Sorted(maps.Keys(caches)) {
+		infos = append(infos, CacheInfo{Name: name, Len: caches[name].Len()})
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+func (router *Router) handleGetCache(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	c, found := router.caches()[name]
+	if !found {
+		writeError(w, r, &Problem{Status: http.StatusNotFound, Code: "unknown_cache", Param: "name", Detail: "Unknown cache " + name})
+		return
+	}
+
+	keys := c.Keys()
+	slices.Sort(keys)
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(CacheInfo{Name: name, Len: len(keys), Keys: keys})
+}
+
+// handleDeleteCache removes a single key with ?key= (sites-9325 for the
+// departures of a site), everything starting with ?prefix= or clears the
+// whole cache when neither is given. A prefix is only a prefix, sites-93
+// takes sites-930 and sites-9325 with it
+func (router *Router) handleDeleteCache(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	c, found := router.caches()[name]
+	if !found {
+		writeError(w, r, &Problem{Status: http.StatusNotFound, Code: "unknown_cache", Param: "name", Detail: "Unknown cache " + name})
+		return
+	}
+
+	query := r.URL.Query()
+	deleted := 0
+
+	switch {
+	case query.Has("key"):
+		if c.Delete(query.Get("key")) {
+			deleted = 1
+		}
+	case query.Has("prefix"):
+		deleted = c.DeletePrefix(query.Get("prefix"))
+	default:
+		deleted = c.Len()
+		c.Clear()
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(DeleteCacheResponse{Deleted: deleted})
+}
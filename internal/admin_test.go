@@ -0,0 +1,134 @@
+package gosltimetable_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gosltimetable "github.com/alexdriaguine/go-sl-time-table/internal"
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const adminToken = "secret"
+
+func newAdminRequest(method string, path string) *http.Request {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("authorization", "Bearer "+adminToken)
+	return req
+}
+
+func TestAdmin(t *testing.T) {
+	setup := func(t *testing.T) (*gosltimetable.Router, *cache.InMemoryCache[string, int]) {
+		t.Setenv("ADMIN_TOKEN", adminToken)
+
+		departures := cache.NewCache[string, int]()
+		departures.Set("sites-9325", 1, time.Minute)
+		departures.Set("sites-930", 2, time.Minute)
+		departures.Set("sites-9001", 3, time.Minute)
+
+		slApiMock, _ := buildSLClientStub(false)
+		slApiMock.caches = map[string]cache.Admin{
+			"departures": departures,
+			"sites":      cache.NewCache[string, string](),
+		}
+
+		router, err := gosltimetable.NewRouter(slApiMock)
+		require.NoError(t, err)
+		return router, departures
+	}
+
+	t.Run("lists caches", func(t *testing.T) {
+		router, _ := setup(t)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newAdminRequest(http.MethodGet, "/api/admin/caches"))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `[
+			{"Name": "departures", "Len": 3},
+			{"Name": "sites", "Len": 0},
+			{"Name": "stale-departures", "Len": 0}
+		]`, response.Body.String())
+	})
+
+	t.Run("lists keys of a cache", func(t *testing.T) {
+		router, _ := setup(t)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newAdminRequest(http.MethodGet, "/api/admin/caches/departures"))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{
+			"Name": "departures",
+			"Len": 3,
+			"Keys": ["sites-9001", "sites-930", "sites-9325"]
+		}`, response.Body.String())
+	})
+
+	t.Run("invalidates by prefix", func(t *testing.T) {
+		router, departures := setup(t)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newAdminRequest(http.MethodDelete, "/api/admin/caches/departures?prefix=sites-93"))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"Deleted": 2}`, response.Body.String())
+		assert.Equal(t, []string{"sites-9001"}, departures.Keys())
+	})
+
+	t.Run("invalidates a single key", func(t *testing.T) {
+		router, departures := setup(t)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newAdminRequest(http.MethodDelete, "/api/admin/caches/departures?key=sites-9325"))
+
+		assert.JSONEq(t, `{"Deleted": 1}`, response.Body.String())
+		assert.Equal(t, 2, departures.Len())
+	})
+
+	t.Run("clears the whole cache", func(t *testing.T) {
+		router, departures := setup(t)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newAdminRequest(http.MethodDelete, "/api/admin/caches/departures"))
+
+		assert.JSONEq(t, `{"Deleted": 3}`, response.Body.String())
+		assert.Equal(t, 0, departures.Len())
+	})
+
+	t.Run("unknown cache returns 404", func(t *testing.T) {
+		router, _ := setup(t)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newAdminRequest(http.MethodGet, "/api/admin/caches/nope"))
+
+		assertProblem(t, response, http.StatusNotFound, "unknown_cache")
+	})
+
+	t.Run("requires the admin token", func(t *testing.T) {
+		router, departures := setup(t)
+
+		request := newAdminRequest(http.MethodDelete, "/api/admin/caches/departures")
+		request.Header.Set("authorization", "Bearer wrong")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		assertProblem(t, response, http.StatusUnauthorized, "unauthorized")
+		assert.Equal(t, 3, departures.Len())
+	})
+
+	t.Run("disabled without a token", func(t *testing.T) {
+		t.Setenv("ADMIN_TOKEN", "")
+		t.Setenv("IS_DEV", "true")
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newAdminRequest(http.MethodGet, "/api/admin/caches"))
+
+		assertProblem(t, response, http.StatusNotFound, "not_found")
+	})
+}
@@ -0,0 +1,234 @@
+// Package v1 is what /api/v1 answers with. The types here are copies of
+// the sl_api models on purpose, sl_api can change as it likes as long as
+// the mapping below keeps the json the same. A breaking change to the
+// json goes in a v2 package next to this one
+package v1
+
+import (
+	"math"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/alexdriaguine/go-sl-time-table/internal/utils"
+)
+
+type Departure struct {
+	Destination string
+	Display     string
+	// the line id, kept for old clients. Use LineDesignation, lines like
+	// 43X or N1 only make sense as strings
+	LineNumber      int
+	LineDesignation string
+	TransportMode   string
+	GroupOfLines    string
+	State           string
+	DirectionCode   int
+	StopArea        StopArea
+	// the designation is the platform or track, "3" or "A"
+	StopPoint StopPoint
+	// the id is the same across polls, use it to follow a departure
+	Journey Journey
+	// in Stockholm time, null when sl didn't send a time we could parse
+	Scheduled *time.Time
+	Expected  *time.Time
+	// expected - scheduled, null unless both are known
+	DelaySeconds *int
+	// until expected, or scheduled when there is no expected time.
+	// Negative for departures that should have left already
+	SecondsUntilDeparture *int
+	Deviations            []Deviation
+}
+
+type StopArea struct {
+	Id   int
+	Name string
+	Type string
+}
+
+type StopPoint struct {
+	Id          int
+	Name        string
+	Designation string
+}
+
+type Journey struct {
+	Id              int64
+	State           string
+	PredictionState string
+}
+
+type Deviation struct {
+	ImportanceLevel int
+	Consequence     string
+	Message         string
+}
+
+type StopDeviation struct {
+	Id              int
+	ImportanceLevel int
+	Message         string
+	// designations of the affected lines, empty when it's the whole stop
+	Lines []string
+}
+
+type Site struct {
+	Id    int
+	Name  string
+	Alias []string
+	// 0, 0 when sl doesn't know where the site is
+	Lat float64
+	Lon float64
+}
+
+// NearbySite is a site with how far away it is, flat like the board
+// departures
+type NearbySite struct {
+	Site
+	// as the crow flies, in whole metres
+	Distance int
+}
+
+// DeparturesResponse is the answer when asking for ?include=deviations,
+// without it the answer is a plain list of departures
+type DeparturesResponse struct {
+	Departures []Departure
+	// most important first
+	StopDeviations []StopDeviation
+}
+
+// DepartureFilters are the filters shared by the departures and board
+// endpoints, from the query string or a json body
+type DepartureFilters struct {
+	Lines      []string
+	Directions []int
+	// sl names or aliases, "BUS", "tunnelbana" or "pendeltåg"
+	Transports []string
+	MinMinutes int
+	MaxMinutes int
+	Limit      int
+}
+
+type BoardRequest struct {
+	Sites []int
+	DepartureFilters
+}
+
+// BoardDeparture is a departure tagged with the site it leaves from
+type BoardDeparture struct {
+	SiteId int
+	Departure
+}
+
+// BoardSite says how getting the departures for a site went, a board
+// with some failed sites still has the departures of the others
+type BoardSite struct {
+	SiteId int
+	// how old the departures are in seconds
+	Age   int
+	Stale bool
+	// empty when we got departures for the site, Code is the same as
+	// the code of the error from the departures endpoint
+	Code  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+type BoardResponse struct {
+	// all sites merged, sorted by expected time
+	Departures []BoardDeparture
+	Sites      []BoardSite
+}
+
+// NearbyDeparture is a departure from one of the sites around a
+// coordinate, flat like the board departures
+type NearbyDeparture struct {
+	SiteId   int
+	SiteName string
+	// an estimate of the walk to the site in metres, see NearbyBoardSite
+	WalkingDistance int
+	Departure
+}
+
+type NearbyBoardSite struct {
+	BoardSite
+	Name string
+	// as the crow flies, in whole metres
+	Distance int
+	// a guess at the walk there in metres, streets aren't straight lines
+	WalkingDistance int
+}
+
+type NearbyBoardResponse struct {
+	// all sites merged, sorted by expected time. A journey leaving from
+	// more than one of the sites is only listed for the closest one
+	Departures []NearbyDeparture
+	// closest first
+	Sites []NearbyBoardSite
+}
+
+func MapDepartures(departures []sl_api.MappedSLDeparture) []Departure {
+	return utils.Map(departures, MapDeparture)
+}
+
+func MapDeparture(d sl_api.MappedSLDeparture) Departure {
+	return Departure{
+		Destination:     d.Destination,
+		Display:         d.Display,
+		LineNumber:      d.LineNumber,
+		LineDesignation: d.LineDesignation,
+		TransportMode:   d.TransportMode,
+		GroupOfLines:    d.GroupOfLines,
+		State:           d.State,
+		DirectionCode:   d.DirectionCode,
+		StopArea: StopArea{
+			Id:   d.StopArea.Id,
+			Name: d.StopArea.Name,
+			Type: d.StopArea.Type,
+		},
+		StopPoint: StopPoint{
+			Id:          d.StopPoint.Id,
+			Name:        d.StopPoint.Name,
+			Designation: d.StopPoint.Designation,
+		},
+		Journey: Journey{
+			Id:              d.Journey.Id,
+			State:           d.Journey.State,
+			PredictionState: d.Journey.PredictionState,
+		},
+		Scheduled:             d.Scheduled,
+		Expected:              d.Expected,
+		DelaySeconds:          d.DelaySeconds,
+		SecondsUntilDeparture: d.SecondsUntilDeparture,
+		Deviations: utils.Map(d.Deviations, func(d sl_api.MappedSLDeviation) Deviation {
+			return Deviation{
+				ImportanceLevel: d.ImportanceLevel,
+				Consequence:     d.Consequence,
+				Message:         d.Message,
+			}
+		}),
+	}
+}
+
+func MapStopDeviations(deviations []sl_api.MappedSLStopDeviation) []StopDeviation {
+	return utils.Map(deviations, func(d sl_api.MappedSLStopDeviation) StopDeviation {
+		return StopDeviation{
+			Id:              d.Id,
+			ImportanceLevel: d.ImportanceLevel,
+			Message:         d.Message,
+			Lines:           d.Lines,
+		}
+	})
+}
+
+func MapSites(sites []sl_api.MappedSLSite) []Site {
+	return utils.Map(sites, MapSite)
+}
+
+func MapSite(s sl_api.MappedSLSite) Site {
+	return Site{Id: s.Id, Name: s.Name, Alias: s.Alias, Lat: s.Lat, Lon: s.Lon}
+}
+
+func MapNearbySites(sites []sl_api.NearbySite) []NearbySite {
+	return utils.Map(sites, func(s sl_api.NearbySite) NearbySite {
+		return NearbySite{Site: MapSite(s.Site), Distance: int(math.Round(s.Distance))}
+	})
+}
@@ -0,0 +1,71 @@
+package v1_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	v1 "github.com/alexdriaguine/go-sl-time-table/internal/api/v1"
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModels(t *testing.T) {
+	t.Run("departure json stays the same", func(t *testing.T) {
+		expected := time.Date(2025, 10, 15, 20, 11, 0, 0, time.UTC)
+		delay, seconds := 0, 60
+
+		departure := v1.MapDeparture(sl_api.MappedSLDeparture{
+			Destination:           "Västerhaninge",
+			Display:               "Nu",
+			LineNumber:            43,
+			LineDesignation:       "43X",
+			TransportMode:         "TRAIN",
+			GroupOfLines:          "Pendeltåg",
+			State:                 "ATSTOP",
+			DirectionCode:         1,
+			StopArea:              sl_api.MappedSLStopArea{Id: 6031, Name: "Sundbyberg", Type: "RAILWSTN"},
+			StopPoint:             sl_api.MappedSLStopPoint{Id: 6032, Name: "Sundbyberg", Designation: "3"},
+			Journey:               sl_api.MappedSLJourney{Id: 2025101502865, State: "NORMALPROGRESS", PredictionState: "NORMAL"},
+			Scheduled:             &expected,
+			Expected:              &expected,
+			DelaySeconds:          &delay,
+			SecondsUntilDeparture: &seconds,
+			Deviations: []sl_api.MappedSLDeviation{
+				{ImportanceLevel: 5, Consequence: "CANCELLED", Message: "Inställd"},
+			},
+		})
+
+		got, err := json.Marshal(departure)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{
+			"Destination": "Västerhaninge",
+			"Display": "Nu",
+			"LineNumber": 43,
+			"LineDesignation": "43X",
+			"TransportMode": "TRAIN",
+			"GroupOfLines": "Pendeltåg",
+			"State": "ATSTOP",
+			"DirectionCode": 1,
+			"StopArea": {"Id": 6031, "Name": "Sundbyberg", "Type": "RAILWSTN"},
+			"StopPoint": {"Id": 6032, "Name": "Sundbyberg", "Designation": "3"},
+			"Journey": {"Id": 2025101502865, "State": "NORMALPROGRESS", "PredictionState": "NORMAL"},
+			"Scheduled": "2025-10-15T20:11:00Z",
+			"Expected": "2025-10-15T20:11:00Z",
+			"DelaySeconds": 0,
+			"SecondsUntilDeparture": 60,
+			"Deviations": [{"ImportanceLevel": 5, "Consequence": "CANCELLED", "Message": "Inställd"}]
+		}`, string(got))
+	})
+
+	t.Run("board departures are flat with the site id", func(t *testing.T) {
+		got, err := json.Marshal(v1.BoardDeparture{SiteId: 9325, Departure: v1.Departure{Destination: "Odenplan"}})
+		require.NoError(t, err)
+
+		var fields map[string]any
+		require.NoError(t, json.Unmarshal(got, &fields))
+		assert.Equal(t, float64(9325), fields["SiteId"])
+		assert.Equal(t, "Odenplan", fields["Destination"])
+	})
+}
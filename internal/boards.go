@@ -0,0 +1,150 @@
+package gosltimetable
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	v1 "github.com/alexdriaguine/go-sl-time-table/internal/api/v1"
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+)
+
+// a board is for a handful of stops around one place, not for crawling sl
+const boardMaxSites = 10
+
+// how many sites of a board we ask sl about at the same time
+const boardConcurrency = 4
+
+// handleGetBoard takes the sites as ?sites=1,2,3 and the same filters as
+// the departures of a site
+func (router *Router) handleGetBoard(w http.ResponseWriter, r *http.Request) {
+	var board v1.BoardRequest
+	for _, querySite := range queryList(r.URL, "sites") {
+		site, err := strconv.Atoi(querySite)
+		if err != nil {
+			writeError(w, r, invalidParam("sites", fmt.Sprintf("%q is not a site id", querySite)))
+			return
+		}
+		board.Sites = append(board.Sites, site)
+	}
+
+	filters, err := parseFiltersFromQuery(r.URL)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	board.DepartureFilters = filters
+
+	router.serveBoard(w, r, board)
+}
+
+func (router *Router) handlePostBoard(w http.ResponseWriter, r *http.Request) {
+	var board v1.BoardRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&board); err != nil {
+		writeError(w, r, newProblem(http.StatusBadRequest, "invalid_body", "The body is not a board, expected json like {\"sites\": [9325]}"))
+		return
+	}
+
+	router.serveBoard(w, r, board)
+}
+
+func (router *Router) serveBoard(w http.ResponseWriter, r *http.Request, board v1.BoardRequest) {
+	// without duplicates, in the order they were asked for
+	var sites []int
+	seen := map[int]bool{}
+	for _, site := range board.Sites {
+		if !seen[site] {
+			seen[site] = true
+			sites = append(sites, site)
+		}
+	}
+
+	if len(sites) == 0 || len(sites) > boardMaxSites {
+		writeError(w, r, invalidParam("sites", fmt.Sprintf("a board needs 1 to %d sites", boardMaxSites)))
+		return
+	}
+
+	args := make([]sl_api.GetDeparturesArgs, len(sites))
+	for i, site := range sites {
+		siteArgs, err := departuresArgs(board.DepartureFilters, site)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		args[i] = siteArgs
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(router.buildBoard(r, args))
+}
+
+// buildBoard gets the departures for every site, at most boardConcurrency
+// at a time. A failed site ends up as an error in Sites
+func (router *Router) buildBoard(r *http.Request, args []sl_api.GetDeparturesArgs) v1.BoardResponse {
+	departures, sites := router.fetchBoard(r, args)
+
+	board := v1.BoardResponse{Departures: []v1.BoardDeparture{}, Sites: sites}
+	for _, d := range departures {
+		board.Departures = append(board.Departures, v1.BoardDeparture{SiteId: d.siteId, Departure: v1.MapDeparture(d.departure)})
+	}
+
+	return board
+}
+
+type siteDeparture struct {
+	siteId    int
+	departure sl_api.MappedSLDeparture
+}
+
+// fetchBoard is the departures of all sites in args sorted by expected
+// time, and how it went for each site in the order of args
+func (router *Router) fetchBoard(r *http.Request, args []sl_api.GetDeparturesArgs) ([]siteDeparture, []v1.BoardSite) {
+	results := make([]sl_api.DeparturesResult, len(args))
+	errs := make([]error, len(args))
+
+	semaphore := make(chan struct{}, boardConcurrency)
+	var wg sync.WaitGroup
+	for i := range args {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			results[i], errs[i] = router.getDepartures(r.Context(), args[i])
+		}()
+	}
+	wg.Wait()
+
+	var departures []siteDeparture
+	sites := []v1.BoardSite{}
+	for i, siteArgs := range args {
+		site := v1.BoardSite{SiteId: siteArgs.SiteId}
+
+		if errs[i] != nil {
+			log.Printf("error getting departures for site %d on board, %v", siteArgs.SiteId, errs[i])
+			problem := upstreamProblem(errs[i])
+			site.Code, site.Error = problem.Code, problem.Detail
+			sites = append(sites, site)
+			continue
+		}
+
+		site.Age = int(results[i].Age.Seconds())
+		site.Stale = results[i].Stale
+		sites = append(sites, site)
+
+		for _, d := range results[i].Departures {
+			departures = append(departures, siteDeparture{siteArgs.SiteId, d})
+		}
+	}
+
+	slices.SortStableFunc(departures, func(a, b siteDeparture) int {
+		return sl_api.CompareDepartsAt(a.departure, b.departure)
+	})
+
+	return departures, sites
+}
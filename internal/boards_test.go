@@ -0,0 +1,100 @@
+package gosltimetable_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gosltimetable "github.com/alexdriaguine/go-sl-time-table/internal"
+	v1 "github.com/alexdriaguine/go-sl-time-table/internal/api/v1"
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func departureAt(destination string, minutes int) sl_api.MappedSLDeparture {
+	expected := time.Date(2025, 1, 15, 8, minutes, 0, 0, time.UTC)
+	return sl_api.MappedSLDeparture{Destination: destination, Expected: &expected}
+}
+
+func TestBoards(t *testing.T) {
+	setup := func() *gosltimetable.Router {
+		router, _ := gosltimetable.NewRouter(buildSitesStub(map[int][]sl_api.MappedSLDeparture{
+			1: {departureAt("a", 1), departureAt("c", 10)},
+			2: {departureAt("b", 5), departureAt("d", 20)},
+		}))
+		return router
+	}
+
+	t.Run("merges sites sorted by expected time and tags the site", func(t *testing.T) {
+		router := setup()
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/boards?sites=2,1,2"))
+		board := decodeJSON[v1.BoardResponse](t, response)
+
+		got := []string{}
+		for _, d := range board.Departures {
+			got = append(got, fmt.Sprintf("%s@%d", d.Destination, d.SiteId))
+		}
+		assert.Equal(t, []string{"a@1", "b@2", "c@1", "d@2"}, got)
+		// in the order asked for, duplicates dropped
+		assert.Equal(t, []v1.BoardSite{{SiteId: 2}, {SiteId: 1}}, board.Sites)
+	})
+
+	t.Run("failed sites are reported without failing the board", func(t *testing.T) {
+		router := setup()
+
+		body := strings.NewReader(`{"sites": [1, 3]}`)
+		request, _ := http.NewRequest(http.MethodPost, "/api/v1/boards", body)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		board := decodeJSON[v1.BoardResponse](t, response)
+
+		assert.Len(t, board.Departures, 2)
+		assert.Equal(t, []v1.BoardSite{
+			{SiteId: 1},
+			{SiteId: 3, Code: "upstream_unavailable", Error: "SL is unavailable"},
+		}, board.Sites)
+	})
+
+	t.Run("post applies filters to every site", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		body := strings.NewReader(`{"sites": [1], "lines": ["43X"], "transports": ["pendeltåg"], "minMinutes": 3}`)
+		request, _ := http.NewRequest(http.MethodPost, "/api/v1/boards", body)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		require.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, []string{"43X"}, slApiMock.lastArgs.Lines)
+		assert.Equal(t, []sl_api.TransportType{sl_api.TransportTrain}, slApiMock.lastArgs.Transports)
+		assert.Equal(t, 3, slApiMock.lastArgs.MinMinutes)
+	})
+
+	t.Run("bad boards return bad request", func(t *testing.T) {
+		router := setup()
+
+		cases := map[string]string{
+			"/api/v1/boards":                               "invalid_sites",
+			"/api/v1/boards?sites=1,x":                     "invalid_sites",
+			"/api/v1/boards?sites=1,2,3,4,5,6,7,8,9,10,11": "invalid_sites",
+			"/api/v1/boards?sites=1&transport=rocket":      "invalid_transport",
+		}
+
+		for path, code := range cases {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, newGetRequest(path))
+			assertProblem(t, response, http.StatusBadRequest, code, path)
+		}
+
+		request, _ := http.NewRequest(http.MethodPost, "/api/v1/boards", strings.NewReader(`{"sites": "1"}`))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		assertProblem(t, response, http.StatusBadRequest, "invalid_body")
+	})
+}
@@ -1,14 +1,21 @@
 package cache
 
 import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
 
 // Clock interface for mocking out time.Now()
-// in tests for ttl/expires
+// in tests for ttl/expires, see cachetest.FakeClock
 type Clock interface {
 	Now() time.Time
+	// NewTicker sends the time every d until stopped, it's what the
+	// janitor sweeps on
+	NewTicker(d time.Duration) (ticks <-chan time.Time, stop func())
 }
 type SystemClock struct{}
 
@@ -16,23 +23,161 @@ func (SystemClock) Now() time.Time {
 	return time.Now()
 }
 
+func (SystemClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
 type Cacher[TKey comparable, TValue any] interface {
 	Get(key TKey) (val TValue, found bool)
 	Set(key TKey, val TValue, ttl time.Duration)
+	GetOrLoad(ctx context.Context, key TKey, ttl time.Duration, load Loader[TValue]) (TValue, error)
+	Delete(key TKey) bool
+	DeletePrefix(prefix string) int
+	Clear()
+	Len() int
+	Keys() []TKey
+	Range(fn func(key TKey, val TValue) bool)
+	Stats() Stats
+}
+
+// Admin is what the admin endpoints need to inspect and invalidate a
+// cache without knowing the value type, any cache with string keys
+// implements it
+type Admin interface {
+	Delete(key string) bool
+	DeletePrefix(prefix string) int
+	Clear()
+	Len() int
+	Keys() []string
+	Stats() Stats
 }
 
+// Ensure implementing interfaces
+var _ Cacher[string, int] = (*InMemoryCache[string, int])(nil)
+var _ Admin = (*InMemoryCache[string, int])(nil)
+
 type CacheValue[TValue any] struct {
 	value   TValue
 	expires time.Time
+	// after this the value is still returned but considered stale,
+	// same as expires for values set without a soft ttl
+	stale  time.Time
+	stored time.Time
+	// position in the lru list, the element value is the key
+	element *list.Element
+	size    int64
+}
+
+// Entry is a cached value together with how old it is
+type Entry[TValue any] struct {
+	Value TValue
+	Age   time.Duration
+	Stale bool
 }
 
 type InMemoryCache[TKey comparable, TValue any] struct {
 	store map[TKey]CacheValue[TValue]
 	clock Clock
 	mu    sync.RWMutex
+	// loads in flight, see GetOrLoad
+	loads   map[TKey]*inflightLoad[TValue]
+	loadsMu sync.Mutex
+	// most recently used key at the front, the zero value is an empty
+	// list so caches created without NewCache work as well
+	lru        list.List
+	maxEntries int
+	maxBytes   int64
+	sizeOf     func(TValue) int64
+	totalBytes int64
+	defaultTTL time.Duration
+	// started by NewCache after all options are applied, so the
+	// janitor never races with WithClock
+	janitorInterval time.Duration
+	onEvict         func(key TKey, value TValue, reason EvictionReason)
+	stop            chan struct{}
+	closeOnce       sync.Once
+	counters        counters
+}
+
+type EvictionReason int
+
+const (
+	// past the hard ttl
+	EvictedExpired EvictionReason = iota
+	// least recently used when the cache was full
+	EvictedCapacity
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictedExpired:
+		return "expired"
+	case EvictedCapacity:
+		return "capacity"
+	default:
+		return "unknown"
+	}
+}
+
+type eviction[TKey comparable, TValue any] struct {
+	key    TKey
+	value  TValue
+	reason EvictionReason
+}
+
+type Option[TKey comparable, TValue any] func(*InMemoryCache[TKey, TValue])
+
+func WithClock[TKey comparable, TValue any](clock Clock) Option[TKey, TValue] {
+	return func(c *InMemoryCache[TKey, TValue]) {
+		c.clock = clock
+	}
+}
+
+// WithDefaultTTL is used by Set and GetOrLoad when called with a ttl of 0
+func WithDefaultTTL[TKey comparable, TValue any](ttl time.Duration) Option[TKey, TValue] {
+	return func(c *InMemoryCache[TKey, TValue]) {
+		c.defaultTTL = ttl
+	}
+}
+
+// WithOnEvict is called for every entry removed because it expired or
+// the cache was full, not for overwritten entries. It's called after
+// the lock is released so it's fine to use the cache from it
+func WithOnEvict[TKey comparable, TValue any](onEvict func(key TKey, value TValue, reason EvictionReason)) Option[TKey, TValue] {
+	return func(c *InMemoryCache[TKey, TValue]) {
+		c.onEvict = onEvict
+	}
+}
+
+// WithMaxEntries evicts the least recently used entry when the cache
+// grows past max entries. 0 means unbounded
+func WithMaxEntries[TKey comparable, TValue any](max int) Option[TKey, TValue] {
+	return func(c *InMemoryCache[TKey, TValue]) {
+		c.maxEntries = max
+	}
+}
+
+// WithMaxBytes evicts least recently used entries while the summed
+// sizeOf of all values is above max. The size is an estimate, it's up
+// to sizeOf to decide what's close enough
+func WithMaxBytes[TKey comparable, TValue any](max int64, sizeOf func(TValue) int64) Option[TKey, TValue] {
+	return func(c *InMemoryCache[TKey, TValue]) {
+		c.maxBytes = max
+		c.sizeOf = sizeOf
+	}
 }
 
-func NewCache[TKey comparable, TValue any]() *InMemoryCache[TKey, TValue] {
+// WithJanitor starts a goroutine sweeping expired entries every
+// interval, without it expired entries are only removed when someone
+// asks for them or they're evicted. Stop it with Close
+func WithJanitor[TKey comparable, TValue any](interval time.Duration) Option[TKey, TValue] {
+	return func(c *InMemoryCache[TKey, TValue]) {
+		c.janitorInterval = interval
+	}
+}
+
+func NewCache[TKey comparable, TValue any](opts ...Option[TKey, TValue]) *InMemoryCache[TKey, TValue] {
 	// maps are actually reference types, underlying points to a hash table
 	// so no need to have pointers to them
 	store := map[TKey]CacheValue[TValue]{}
@@ -40,50 +185,293 @@ func NewCache[TKey comparable, TValue any]() *InMemoryCache[TKey, TValue] {
 	// return copies lock value: github.com/alexdriaguine/go-sl-time-table/internal/cache.InMemoryCache[TKey, TValue] contains sync.RWMutexcopylocksdefault
 	// because of locks and that they must never be copies
 	// the cache must always be a pointer
-	return &InMemoryCache[TKey, TValue]{
-		store,
-		SystemClock{},
-		sync.RWMutex{},
+	c := &InMemoryCache[TKey, TValue]{
+		store: store,
+		clock: SystemClock{},
+		loads: map[TKey]*inflightLoad[TValue]{},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.janitorInterval > 0 {
+		c.stop = make(chan struct{})
+		// the ticker is made here so it ticks from the time the cache
+		// was made, whenever the goroutine gets going
+		ticks, stopTicks := c.clock.NewTicker(c.janitorInterval)
+		go c.janitor(ticks, stopTicks)
 	}
+
+	return c
 }
 
 // Get passes lock by value: github.com/alexdriaguine/go-sl-time-table/internal/cache.InMemoryCache[TKey, TValue] contains sync.RWMutexcopylocksdefault
 // the cache MUST use pointer receivers, same reason to why we must
 // use the InMemoryCache as a pointer, because we can never copy locks, the lock.
 func (c *InMemoryCache[TKey, TValue]) Get(key TKey) (TValue, bool) {
-	// can't defer here because in case of expired ttl, need to
-	// upgrade to a read lock and delete the entry
-	c.mu.RLock()
+	entry, found := c.GetEntry(key)
+	return entry.Value, found
+}
+
+func (c *InMemoryCache[TKey, TValue]) Set(key TKey, value TValue, ttl time.Duration) {
+	c.SetWithStale(key, value, ttl, ttl)
+}
+
+// SetWithStale stores a value that is fresh for softTTL and then kept
+// around as stale until hardTTL has passed
+func (c *InMemoryCache[TKey, TValue]) SetWithStale(key TKey, value TValue, softTTL time.Duration, hardTTL time.Duration) {
+	softTTL = c.ttlOrDefault(softTTL)
+	hardTTL = c.ttlOrDefault(hardTTL)
+
+	c.counters.sets.Add(1)
+	c.mu.Lock()
+
+	if old, found := c.store[key]; found {
+		c.remove(key, old)
+	}
+
+	var size int64
+	if c.sizeOf != nil {
+		size = c.sizeOf(value)
+	}
+
+	now := c.clock.Now()
+	c.store[key] = CacheValue[TValue]{
+		value:   value,
+		expires: now.Add(hardTTL),
+		stale:   now.Add(softTTL),
+		stored:  now,
+		element: c.lru.PushFront(key),
+		size:    size,
+	}
+	c.totalBytes += size
+
+	evicted := c.evict()
+	c.mu.Unlock()
+
+	c.notifyEvicted(evicted)
+}
+
+func (c *InMemoryCache[TKey, TValue]) ttlOrDefault(ttl time.Duration) time.Duration {
+	if ttl == 0 {
+		return c.defaultTTL
+	}
+	return ttl
+}
+
+// GetEntry is like Get but also tells if the value is past its soft ttl
+// and how old it is
+func (c *InMemoryCache[TKey, TValue]) GetEntry(key TKey) (Entry[TValue], bool) {
+	entry, found := c.getEntry(key)
+	if found {
+		c.counters.hits.Add(1)
+	} else {
+		c.counters.misses.Add(1)
+	}
+	return entry, found
+}
+
+// getEntry doesn't count hits and misses, for lookups that aren't
+// really a separate use of the cache
+func (c *InMemoryCache[TKey, TValue]) getEntry(key TKey) (Entry[TValue], bool) {
+	// a full lock even for reads, every hit moves the key in the lru list
+	c.mu.Lock()
+
 	val, found := c.store[key]
 	if !found {
-		c.mu.RUnlock()
+		c.mu.Unlock()
+		return Entry[TValue]{}, false
+	}
 
-		// just creates an empty zero value of type TValue
-		var empty TValue
-		return empty, false
+	now := c.clock.Now()
+	if now.After(val.expires) {
+		c.remove(key, val)
+		c.mu.Unlock()
+
+		c.notifyEvicted([]eviction[TKey, TValue]{{key, val.value, EvictedExpired}})
+		return Entry[TValue]{}, false
 	}
 
-	if c.clock.Now().After(val.expires) {
-		c.mu.RUnlock()
-		c.mu.Lock()
+	defer c.mu.Unlock()
 
-		delete(c.store, key)
+	c.lru.MoveToFront(val.element)
 
-		c.mu.Unlock()
+	return Entry[TValue]{
+		Value: val.value,
+		Age:   now.Sub(val.stored),
+		Stale: now.After(val.stale),
+	}, true
+}
+
+// DeleteExpired removes all entries past their hard ttl, this is what
+// the janitor runs on every tick
+func (c *InMemoryCache[TKey, TValue]) DeleteExpired() {
+	c.mu.Lock()
 
-		var empty TValue
-		return empty, false
+	var evicted []eviction[TKey, TValue]
+	now := c.clock.Now()
+	for key, val := range c.store {
+		if now.After(val.expires) {
+			c.remove(key, val)
+			evicted = append(evicted, eviction[TKey, TValue]{key, val.value, EvictedExpired})
+		}
 	}
+	c.mu.Unlock()
 
-	c.mu.RUnlock()
-	return val.value, true
+	c.notifyEvicted(evicted)
 }
 
-func (c *InMemoryCache[TKey, TValue]) Set(key TKey, value TValue, ttl time.Duration) {
+// Delete removes key, returns false if it wasn't cached
+func (c *InMemoryCache[TKey, TValue]) Delete(key TKey) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.store[key] = CacheValue[TValue]{
-		value:   value,
-		expires: time.Now().Add(ttl),
+
+	val, found := c.store[key]
+	if found {
+		c.remove(key, val)
 	}
+	return found
+}
+
+// DeletePrefix removes all keys starting with prefix and returns how
+// many were removed. Keys that aren't strings are compared using their
+// fmt.Sprint representation
+func (c *InMemoryCache[TKey, TValue]) DeletePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deleted := 0
+	for key, val := range c.store {
+		if strings.HasPrefix(keyString(key), prefix) {
+			c.remove(key, val)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (c *InMemoryCache[TKey, TValue]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.store)
+	c.lru.Init()
+	c.totalBytes = 0
+}
+
+// Len is the number of entries that haven't expired
+func (c *InMemoryCache[TKey, TValue]) Len() int {
+	count := 0
+	c.Range(func(TKey, TValue) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// Keys of all entries that haven't expired, in no particular order
+func (c *InMemoryCache[TKey, TValue]) Keys() []TKey {
+	keys := []TKey{}
+	c.Range(func(key TKey, _ TValue) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range calls fn for every entry that hasn't expired until fn returns
+// false. It doesn't count as use for the lru and holds a read lock, so
+// fn must not write to the cache
+func (c *InMemoryCache[TKey, TValue]) Range(fn func(key TKey, val TValue) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := c.clock.Now()
+	for key, val := range c.store {
+		if now.After(val.expires) {
+			continue
+		}
+		if !fn(key, val.value) {
+			return
+		}
+	}
+}
+
+// Close stops the janitor, safe to call on caches without one and more
+// than once
+func (c *InMemoryCache[TKey, TValue]) Close() {
+	c.closeOnce.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+		}
+	})
+}
+
+func (c *InMemoryCache[TKey, TValue]) janitor(ticks <-chan time.Time, stopTicks func()) {
+	defer stopTicks()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticks:
+			c.DeleteExpired()
+		}
+	}
+}
+
+// evict drops least recently used entries until we're within bounds,
+// must be called with the lock held
+func (c *InMemoryCache[TKey, TValue]) evict() []eviction[TKey, TValue] {
+	var evicted []eviction[TKey, TValue]
+	for c.overLimit() {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		key := oldest.Value.(TKey)
+		val := c.store[key]
+		c.remove(key, val)
+		evicted = append(evicted, eviction[TKey, TValue]{key, val.value, EvictedCapacity})
+	}
+	return evicted
+}
+
+// notifyEvicted counts the evictions and calls onEvict, must be called
+// without the lock held
+func (c *InMemoryCache[TKey, TValue]) notifyEvicted(evicted []eviction[TKey, TValue]) {
+	for _, e := range evicted {
+		switch e.reason {
+		case EvictedExpired:
+			c.counters.expirations.Add(1)
+		case EvictedCapacity:
+			c.counters.evictions.Add(1)
+		}
+
+		if c.onEvict != nil {
+			c.onEvict(e.key, e.value, e.reason)
+		}
+	}
+}
+
+func (c *InMemoryCache[TKey, TValue]) overLimit() bool {
+	if c.maxEntries > 0 && len(c.store) > c.maxEntries {
+		return true
+	}
+	return c.maxBytes > 0 && c.totalBytes > c.maxBytes
+}
+
+func keyString(key any) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// remove must be called with the lock held
+func (c *InMemoryCache[TKey, TValue]) remove(key TKey, val CacheValue[TValue]) {
+	delete(c.store, key)
+	c.lru.Remove(val.element)
+	c.totalBytes -= val.size
 }
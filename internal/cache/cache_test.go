@@ -1,32 +1,16 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache/cachetest"
 	"github.com/stretchr/testify/assert"
 )
 
-type StubClock struct {
-	now time.Time
-}
-
-func NewStubClock() *StubClock {
-	return &StubClock{
-		now: time.Now(),
-	}
-}
-
-func (s *StubClock) Now() time.Time {
-	return s.now
-}
-
-func (s *StubClock) advanceBy(d time.Duration) {
-	s.now = s.now.Add(d)
-}
-
 func TestCache(t *testing.T) {
 	t.Run("add and get value", func(t *testing.T) {
 		t.Skip()
@@ -42,8 +26,8 @@ func TestCache(t *testing.T) {
 	})
 
 	t.Run("ttl works", func(t *testing.T) {
-		clock := NewStubClock()
-		cache := &InMemoryCache[string, int]{map[string]CacheValue[int]{}, clock, sync.RWMutex{}}
+		clock := cachetest.NewFakeClock(time.Now())
+		cache := NewCache(WithClock[string, int](clock))
 		key := "hello"
 		val := 12
 
@@ -53,19 +37,289 @@ func TestCache(t *testing.T) {
 		assert.True(t, found)
 		assert.Equal(t, got, val)
 
-		clock.advanceBy(4 * time.Minute)
+		clock.Advance(4 * time.Minute)
 
 		got, found = cache.Get(key)
 		assert.True(t, found)
 		assert.Equal(t, val, got)
 
-		clock.advanceBy(61 * time.Second)
+		clock.Advance(61 * time.Second)
 
 		_, found = cache.Get(key)
 		assert.False(t, found)
 		assert.Equal(t, len(cache.store), 0)
 	})
 
+	t.Run("soft ttl marks entries stale until the hard ttl", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		cache := NewCache(WithClock[string, int](clock))
+
+		cache.SetWithStale("hello", 12, 5*time.Second, time.Minute)
+
+		entry, found := cache.GetEntry("hello")
+		assert.True(t, found)
+		assert.Equal(t, Entry[int]{Value: 12, Age: 0, Stale: false}, entry)
+
+		clock.Advance(10 * time.Second)
+
+		entry, found = cache.GetEntry("hello")
+		assert.True(t, found)
+		assert.Equal(t, Entry[int]{Value: 12, Age: 10 * time.Second, Stale: true}, entry)
+
+		clock.Advance(51 * time.Second)
+
+		_, found = cache.GetEntry("hello")
+		assert.False(t, found)
+		assert.Equal(t, len(cache.store), 0)
+	})
+
+	t.Run("evicts least recently used entry past max entries", func(t *testing.T) {
+		cache := NewCache(WithMaxEntries[string, int](2))
+
+		cache.Set("a", 1, time.Minute)
+		cache.Set("b", 2, time.Minute)
+
+		// reading a makes b the least recently used
+		cache.Get("a")
+		cache.Set("c", 3, time.Minute)
+
+		_, found := cache.Get("b")
+		assert.False(t, found)
+
+		got, found := cache.Get("a")
+		assert.True(t, found)
+		assert.Equal(t, 1, got)
+
+		got, found = cache.Get("c")
+		assert.True(t, found)
+		assert.Equal(t, 3, got)
+		assert.Equal(t, 2, len(cache.store))
+		assert.Equal(t, 2, cache.lru.Len())
+	})
+
+	t.Run("overwriting a key does not count twice", func(t *testing.T) {
+		cache := NewCache(WithMaxEntries[string, int](2))
+
+		cache.Set("a", 1, time.Minute)
+		cache.Set("b", 2, time.Minute)
+		cache.Set("a", 3, time.Minute)
+
+		_, found := cache.Get("b")
+		assert.True(t, found)
+		got, _ := cache.Get("a")
+		assert.Equal(t, 3, got)
+		assert.Equal(t, 2, cache.lru.Len())
+	})
+
+	t.Run("evicts past max bytes", func(t *testing.T) {
+		cache := NewCache(WithMaxBytes[string, string](10, func(s string) int64 {
+			return int64(len(s))
+		}))
+
+		cache.Set("a", "12345", time.Minute)
+		cache.Set("b", "1234", time.Minute)
+		cache.Set("c", "123", time.Minute)
+
+		_, found := cache.Get("a")
+		assert.False(t, found)
+		_, found = cache.Get("b")
+		assert.True(t, found)
+		assert.Equal(t, int64(7), cache.totalBytes)
+	})
+
+	t.Run("delete expired sweeps entries past their ttl", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		cache := NewCache(WithClock[string, int](clock))
+
+		cache.Set("short", 1, time.Second)
+		cache.Set("long", 2, time.Minute)
+
+		clock.Advance(2 * time.Second)
+		cache.DeleteExpired()
+
+		assert.Equal(t, 1, len(cache.store))
+		assert.Equal(t, 1, cache.lru.Len())
+		_, found := cache.store["long"]
+		assert.True(t, found)
+	})
+
+	t.Run("janitor sweeps on the clock until closed", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		swept := make(chan string, 1)
+		cache := NewCache(
+			WithClock[string, int](clock),
+			WithJanitor[string, int](time.Minute),
+			WithOnEvict(func(key string, value int, reason EvictionReason) { swept <- key }),
+		)
+		defer cache.Close()
+
+		cache.Set("key", 1, time.Second)
+		clock.Advance(2 * time.Second)
+		select {
+		case key := <-swept:
+			t.Fatalf("swept %s before the janitor's interval", key)
+		default:
+		}
+
+		clock.Advance(time.Minute)
+		assert.Equal(t, "key", <-swept)
+
+		cache.Close()
+		cache.Close()
+	})
+
+	t.Run("zero ttl uses the default ttl", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		cache := NewCache(WithClock[string, int](clock), WithDefaultTTL[string, int](time.Minute))
+
+		cache.Set("key", 1, 0)
+		cache.GetOrLoad(context.Background(), "loaded", 0, func(ctx context.Context) (int, error) { return 2, nil })
+
+		clock.Advance(59 * time.Second)
+		_, found := cache.Get("key")
+		assert.True(t, found)
+		_, found = cache.Get("loaded")
+		assert.True(t, found)
+
+		clock.Advance(2 * time.Second)
+		_, found = cache.Get("key")
+		assert.False(t, found)
+		_, found = cache.Get("loaded")
+		assert.False(t, found)
+	})
+
+	t.Run("on evict is called for expired and evicted entries", func(t *testing.T) {
+		type evicted struct {
+			key    string
+			value  int
+			reason EvictionReason
+		}
+		var got []evicted
+
+		clock := cachetest.NewFakeClock(time.Now())
+		var cache *InMemoryCache[string, int]
+		cache = NewCache(
+			WithClock[string, int](clock),
+			WithMaxEntries[string, int](2),
+			WithOnEvict(func(key string, value int, reason EvictionReason) {
+				// the lock is released before calling, so this doesn't deadlock
+				cache.Get(key)
+				got = append(got, evicted{key, value, reason})
+			}),
+		)
+
+		cache.Set("a", 1, time.Second)
+		cache.Set("b", 2, time.Minute)
+		cache.Set("b", 3, time.Minute)
+		cache.Set("c", 4, time.Minute)
+
+		clock.Advance(2 * time.Minute)
+		cache.Get("b")
+		cache.DeleteExpired()
+
+		assert.ElementsMatch(t, []evicted{
+			{"a", 1, EvictedCapacity},
+			{"b", 3, EvictedExpired},
+			{"c", 4, EvictedExpired},
+		}, got)
+	})
+
+	t.Run("delete, len, keys and clear", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		cache := NewCache(WithClock[string, int](clock))
+
+		cache.Set("sites-1-0", 1, time.Minute)
+		cache.Set("sites-1-43", 2, time.Minute)
+		cache.Set("sites-2-0", 3, time.Minute)
+		cache.Set("expires", 4, time.Second)
+
+		assert.Equal(t, 4, cache.Len())
+
+		clock.Advance(2 * time.Second)
+		assert.Equal(t, 3, cache.Len())
+		assert.ElementsMatch(t, []string{"sites-1-0", "sites-1-43", "sites-2-0"}, cache.Keys())
+
+		assert.True(t, cache.Delete("sites-2-0"))
+		assert.False(t, cache.Delete("sites-2-0"))
+		assert.Equal(t, 2, cache.Len())
+
+		cache.Clear()
+		assert.Equal(t, 0, cache.Len())
+		assert.Equal(t, 0, cache.lru.Len())
+		assert.Equal(t, []string{}, cache.Keys())
+	})
+
+	t.Run("delete prefix", func(t *testing.T) {
+		cache := NewCache[string, int]()
+
+		cache.Set("sites-1-0", 1, time.Minute)
+		cache.Set("sites-1-43", 2, time.Minute)
+		cache.Set("sites-10-0", 3, time.Minute)
+
+		assert.Equal(t, 2, cache.DeletePrefix("sites-1-"))
+		assert.Equal(t, []string{"sites-10-0"}, cache.Keys())
+		assert.Equal(t, 1, cache.lru.Len())
+
+		ints := NewCache[int, int]()
+		ints.Set(12, 1, time.Minute)
+		ints.Set(13, 1, time.Minute)
+		ints.Set(21, 1, time.Minute)
+
+		assert.Equal(t, 2, ints.DeletePrefix("1"))
+		assert.Equal(t, []int{21}, ints.Keys())
+	})
+
+	t.Run("range stops when fn returns false", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		cache.Set("a", 1, time.Minute)
+		cache.Set("b", 2, time.Minute)
+		cache.Set("c", 3, time.Minute)
+
+		sum := 0
+		calls := 0
+		cache.Range(func(key string, val int) bool {
+			sum += val
+			calls++
+			return calls < 2
+		})
+
+		assert.Equal(t, 2, calls)
+		assert.Greater(t, sum, 0)
+	})
+
+	t.Run("counts hits, misses, sets, expirations and evictions", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		cache := NewCache(WithClock[string, int](clock), WithMaxEntries[string, int](2))
+
+		cache.Set("a", 1, time.Second)
+		cache.Set("b", 2, time.Minute)
+		cache.Get("a")
+		cache.Get("nope")
+		// evicts b, a was used more recently
+		cache.GetOrLoad(context.Background(), "c", time.Minute, func(ctx context.Context) (int, error) { return 3, nil })
+
+		clock.Advance(2 * time.Second)
+		cache.Get("b")
+		cache.DeleteExpired()
+
+		assert.Equal(t, Stats{
+			Hits:        1,
+			Misses:      3,
+			Sets:        3,
+			Expirations: 1,
+			Evictions:   1,
+			Entries:     1,
+		}, cache.Stats())
+
+		clock.Advance(2 * time.Minute)
+		cache.Get("b")
+		cache.DeleteExpired()
+
+		stats := cache.Stats()
+		assert.Equal(t, uint64(2), stats.Expirations)
+		assert.Equal(t, 0, stats.Entries)
+	})
+
 	t.Run("test concurrent writes", func(t *testing.T) {
 		cache := NewCache[string, int]()
 
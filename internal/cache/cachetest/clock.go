@@ -0,0 +1,82 @@
+// Package cachetest has helpers for tests that need to control time in
+// the cache and anything built on top of it
+package cachetest
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// FakeClock implements cache.Clock, time only moves when told to. Safe
+// to advance while background goroutines (janitor, refreshes) read it
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	ticks    chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker ticks when the clock is moved past the next tick. Like a
+// time.Ticker it drops ticks nobody is there to take, moving the clock
+// past several ticks at once sends one
+func (c *FakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ticker := &fakeTicker{ticks: make(chan time.Time, 1), interval: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, ticker)
+
+	stop := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.tickers = slices.DeleteFunc(c.tickers, func(t *fakeTicker) bool { return t == ticker })
+	}
+	return ticker.ticks, stop
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.tick()
+}
+
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+	c.tick()
+}
+
+// tick sends to the tickers that are due, must be called with the lock
+// held
+func (c *FakeClock) tick() {
+	for _, ticker := range c.tickers {
+		if c.now.Before(ticker.next) {
+			continue
+		}
+		select {
+		case ticker.ticks <- c.now:
+		default:
+		}
+		for !c.now.Before(ticker.next) {
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// a background refresh has no caller to be cancelled by, this is how
+// long it gets instead
+const refreshTimeout = 30 * time.Second
+
+type inflightLoad[TValue any] struct {
+	done  chan struct{}
+	value TValue
+	err   error
+	// what the load runs on, cancelled when the last caller waiting for
+	// it leaves
+	ctx    context.Context
+	cancel context.CancelFunc
+	// callers waiting for the load, guarded by loadsMu
+	waiters int
+	// refreshes don't belong to any caller and aren't cancelled when
+	// the callers that joined them leave
+	background bool
+}
+
+// GetOrLoad returns the cached value for key, or calls load and caches
+// the result for ttl (or the default ttl if 0). Concurrent calls for the same missing key share a
+// single call to load and all get its value or error, so 50 clients
+// polling the same site only cause one request to sl. A caller whose ctx
+// is done stops waiting, the load is only cancelled once every caller
+// waiting for it is gone
+func (c *InMemoryCache[TKey, TValue]) GetOrLoad(ctx context.Context, key TKey, ttl time.Duration, load Loader[TValue]) (TValue, error) {
+	if value, found := c.Get(key); found {
+		return value, nil
+	}
+
+	return c.load(ctx, key, func(ctx context.Context) (TValue, error) {
+		// someone else might have loaded it between our Get and
+		// becoming the one doing the load
+		if entry, found := c.getEntry(key); found {
+			return entry.Value, nil
+		}
+
+		value, err := load(ctx)
+		if err == nil {
+			c.Set(key, value, ttl)
+		}
+		return value, err
+	})
+}
+
+// load calls fn once for all concurrent callers with the same key. fn
+// runs on a context with the values of the caller that started it, but
+// it's only cancelled when all callers have left, the first one going
+// away shouldn't fail everyone else waiting
+func (c *InMemoryCache[TKey, TValue]) load(ctx context.Context, key TKey, fn Loader[TValue]) (TValue, error) {
+	var zero TValue
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	call, leader := c.join(ctx, key, false)
+	if leader {
+		go c.run(key, call, fn)
+	}
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		c.leave(key, call)
+		return zero, ctx.Err()
+	}
+}
+
+// join returns the load in flight for key, leader is true if there was
+// none and the caller is responsible for running it. Unless background,
+// the caller is counted as waiting for the load until it's done or the
+// caller leaves
+func (c *InMemoryCache[TKey, TValue]) join(ctx context.Context, key TKey, background bool) (call *inflightLoad[TValue], leader bool) {
+	c.loadsMu.Lock()
+	defer c.loadsMu.Unlock()
+
+	// caches created without NewCache, like in tests
+	if c.loads == nil {
+		c.loads = map[TKey]*inflightLoad[TValue]{}
+	}
+
+	if call, found := c.loads[key]; found {
+		if !background {
+			call.waiters++
+		}
+		return call, false
+	}
+
+	call = &inflightLoad[TValue]{done: make(chan struct{}), background: background}
+	if background {
+		call.ctx, call.cancel = context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+	} else {
+		call.ctx, call.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		call.waiters = 1
+	}
+	c.loads[key] = call
+	return call, true
+}
+
+// leave stops counting a caller as waiting for call, the last one to
+// leave cancels it. It's forgotten right away so callers coming after
+// start a new load instead of getting the cancelled one's error
+func (c *InMemoryCache[TKey, TValue]) leave(key TKey, call *inflightLoad[TValue]) {
+	c.loadsMu.Lock()
+	defer c.loadsMu.Unlock()
+
+	call.waiters--
+	if call.waiters > 0 || call.background {
+		return
+	}
+
+	call.cancel()
+	if c.loads[key] == call {
+		delete(c.loads, key)
+	}
+}
+
+func (c *InMemoryCache[TKey, TValue]) run(key TKey, call *inflightLoad[TValue], fn Loader[TValue]) {
+	defer func() {
+		c.loadsMu.Lock()
+		if c.loads[key] == call {
+			delete(c.loads, key)
+		}
+		c.loadsMu.Unlock()
+
+		call.cancel()
+		close(call.done)
+	}()
+
+	call.value, call.err = fn(call.ctx)
+}
@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOrLoad(t *testing.T) {
+	t.Run("loads on miss and caches the value", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		var loads atomic.Int32
+		load := func(ctx context.Context) (int, error) {
+			return int(loads.Add(1)), nil
+		}
+
+		got, err := cache.GetOrLoad(context.Background(), "key", time.Minute, load)
+		require.NoError(t, err)
+		assert.Equal(t, 1, got)
+
+		got, err = cache.GetOrLoad(context.Background(), "key", time.Minute, load)
+		require.NoError(t, err)
+		assert.Equal(t, 1, got)
+		assert.Equal(t, int32(1), loads.Load())
+	})
+
+	t.Run("concurrent misses share a single load", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		var loads atomic.Int32
+		release := make(chan struct{})
+		load := func(ctx context.Context) (int, error) {
+			loads.Add(1)
+			<-release
+			return 42, nil
+		}
+
+		var wg sync.WaitGroup
+		results := make([]int, 50)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], _ = cache.GetOrLoad(context.Background(), "key", time.Minute, load)
+			}(i)
+		}
+
+		// let the goroutines pile up on the load before it finishes
+		assert.Eventually(t, func() bool { return loads.Load() == 1 }, time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), loads.Load())
+		for _, result := range results {
+			assert.Equal(t, 42, result)
+		}
+	})
+
+	t.Run("errors are shared and not cached", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		var loads atomic.Int32
+		release := make(chan struct{})
+		failing := func(ctx context.Context) (int, error) {
+			loads.Add(1)
+			<-release
+			return 0, errors.New("sl is down")
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = cache.GetOrLoad(context.Background(), "key", time.Minute, failing)
+			}(i)
+		}
+
+		assert.Eventually(t, func() bool { return loads.Load() == 1 }, time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		for _, err := range errs {
+			assert.EqualError(t, err, "sl is down")
+		}
+
+		got, err := cache.GetOrLoad(context.Background(), "key", time.Minute, func(ctx context.Context) (int, error) { return 1, nil })
+		require.NoError(t, err)
+		assert.Equal(t, 1, got)
+	})
+
+	t.Run("different keys load independently", func(t *testing.T) {
+		cache := NewCache[string, int]()
+
+		a, _ := cache.GetOrLoad(context.Background(), "a", time.Minute, func(ctx context.Context) (int, error) { return 1, nil })
+		b, _ := cache.GetOrLoad(context.Background(), "b", time.Minute, func(ctx context.Context) (int, error) { return 2, nil })
+
+		assert.Equal(t, 1, a)
+		assert.Equal(t, 2, b)
+	})
+
+	t.Run("the first caller going away doesn't fail the others", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		release := make(chan struct{})
+		load := func(ctx context.Context) (int, error) {
+			select {
+			case <-release:
+				return 42, nil
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+
+		first, cancel := context.WithCancel(context.Background())
+		firstErr := make(chan error)
+		go func() {
+			_, err := cache.GetOrLoad(first, "key", time.Minute, load)
+			firstErr <- err
+		}()
+
+		// the second caller joins the load the first one started
+		assert.Eventually(t, func() bool {
+			cache.loadsMu.Lock()
+			defer cache.loadsMu.Unlock()
+			return cache.loads["key"] != nil
+		}, time.Second, time.Millisecond)
+		second := make(chan int)
+		go func() {
+			got, err := cache.GetOrLoad(context.Background(), "key", time.Minute, load)
+			assert.NoError(t, err)
+			second <- got
+		}()
+		assert.Eventually(t, func() bool {
+			cache.loadsMu.Lock()
+			defer cache.loadsMu.Unlock()
+			return cache.loads["key"].waiters == 2
+		}, time.Second, time.Millisecond)
+
+		cancel()
+		assert.ErrorIs(t, <-firstErr, context.Canceled)
+
+		close(release)
+		assert.Equal(t, 42, <-second)
+
+		got, found := cache.Get("key")
+		assert.True(t, found)
+		assert.Equal(t, 42, got)
+	})
+
+	t.Run("waiting callers give up when their context is done", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		release := make(chan struct{})
+		defer close(release)
+		load := func(ctx context.Context) (int, error) {
+			<-release
+			return 42, nil
+		}
+
+		go cache.GetOrLoad(context.Background(), "key", time.Minute, load)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := cache.GetOrLoad(ctx, "key", time.Minute, load)
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("the load is cancelled when every caller has left", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		cancelled := make(chan struct{})
+		load := func(ctx context.Context) (int, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return 0, ctx.Err()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := cache.GetOrLoad(ctx, "key", time.Minute, load)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("the load carried on without anyone waiting for it")
+		}
+
+		// and the next caller gets a load of its own
+		got, err := cache.GetOrLoad(context.Background(), "key", time.Minute, func(ctx context.Context) (int, error) { return 1, nil })
+		require.NoError(t, err)
+		assert.Equal(t, 1, got)
+	})
+
+	t.Run("an already cancelled caller doesn't start a load", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := cache.GetOrLoad(ctx, "key", time.Minute, func(ctx context.Context) (int, error) {
+			t.Error("loaded for a cancelled caller")
+			return 0, nil
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
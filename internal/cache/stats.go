@@ -0,0 +1,38 @@
+package cache
+
+import "sync/atomic"
+
+// Stats is a snapshot of what the cache has been up to since it was
+// created, the counters only ever go up
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Sets        uint64
+	Expirations uint64
+	Evictions   uint64
+	// current number of entries, including expired ones not swept yet
+	Entries int
+}
+
+type counters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	sets        atomic.Uint64
+	expirations atomic.Uint64
+	evictions   atomic.Uint64
+}
+
+func (c *InMemoryCache[TKey, TValue]) Stats() Stats {
+	c.mu.RLock()
+	entries := len(c.store)
+	c.mu.RUnlock()
+
+	return Stats{
+		Hits:        c.counters.hits.Load(),
+		Misses:      c.counters.misses.Load(),
+		Sets:        c.counters.sets.Load(),
+		Expirations: c.counters.expirations.Load(),
+		Evictions:   c.counters.evictions.Load(),
+		Entries:     entries,
+	}
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type Loader[TValue any] func(ctx context.Context) (TValue, error)
+
+// StaleWhileRevalidate serves values past their soft ttl right away and
+// refreshes them in the background. If the refresh fails the stale value
+// keeps being served until the hard ttl has passed
+type StaleWhileRevalidate[TKey comparable, TValue any] struct {
+	cache   *InMemoryCache[TKey, TValue]
+	softTTL time.Duration
+	hardTTL time.Duration
+}
+
+func NewStaleWhileRevalidate[TKey comparable, TValue any](
+	cache *InMemoryCache[TKey, TValue],
+	softTTL time.Duration,
+	hardTTL time.Duration,
+) *StaleWhileRevalidate[TKey, TValue] {
+	return &StaleWhileRevalidate[TKey, TValue]{
+		cache:   cache,
+		softTTL: softTTL,
+		hardTTL: hardTTL,
+	}
+}
+
+// GetOrLoad returns the cached entry for key, calling load when there's
+// nothing cached. A stale entry is returned as is and refreshed in the
+// background. Like InMemoryCache.GetOrLoad concurrent loads and
+// refreshes of the same key share a single call to load
+func (s *StaleWhileRevalidate[TKey, TValue]) GetOrLoad(ctx context.Context, key TKey, load Loader[TValue]) (Entry[TValue], error) {
+	entry, found := s.cache.GetEntry(key)
+
+	if !found {
+		value, err := s.cache.load(ctx, key, func(ctx context.Context) (TValue, error) {
+			return s.loadAndSet(ctx, key, load)
+		})
+		if err != nil {
+			return Entry[TValue]{}, err
+		}
+		return Entry[TValue]{Value: value}, nil
+	}
+
+	if entry.Stale {
+		s.refresh(ctx, key, load)
+	}
+
+	return entry, nil
+}
+
+// Cache is the underlying cache, for inspecting and invalidating entries
+func (s *StaleWhileRevalidate[TKey, TValue]) Cache() *InMemoryCache[TKey, TValue] {
+	return s.cache
+}
+
+// Close stops the janitor of the underlying cache, if any
+func (s *StaleWhileRevalidate[TKey, TValue]) Close() {
+	s.cache.Close()
+}
+
+func (s *StaleWhileRevalidate[TKey, TValue]) refresh(ctx context.Context, key TKey, load Loader[TValue]) {
+	// the refresh outlives the request that triggered it, so it can't
+	// be cancelled when that request is done
+	call, leader := s.cache.join(ctx, key, true)
+	if !leader {
+		return
+	}
+
+	go s.cache.run(key, call, func(ctx context.Context) (TValue, error) {
+		value, err := s.loadAndSet(ctx, key, load)
+		if err != nil {
+			// keep serving the stale value until the hard ttl
+			log.Printf("error refreshing stale cache entry %v, %v", key, err)
+		}
+		return value, err
+	})
+}
+
+func (s *StaleWhileRevalidate[TKey, TValue]) loadAndSet(ctx context.Context, key TKey, load Loader[TValue]) (TValue, error) {
+	value, err := load(ctx)
+	if err == nil {
+		s.cache.SetWithStale(key, value, s.softTTL, s.hardTTL)
+	}
+	return value, err
+}
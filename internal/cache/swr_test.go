@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache/cachetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	newSWR := func(clock Clock) *StaleWhileRevalidate[string, int] {
+		cache := NewCache(WithClock[string, int](clock))
+		return NewStaleWhileRevalidate(cache, 5*time.Second, time.Minute)
+	}
+
+	t.Run("loads on miss and serves fresh values from cache", func(t *testing.T) {
+		swr := newSWR(cachetest.NewFakeClock(time.Now()))
+		var loads atomic.Int32
+		load := func(ctx context.Context) (int, error) {
+			return int(loads.Add(1)), nil
+		}
+
+		entry, err := swr.GetOrLoad(context.Background(), "key", load)
+		require.NoError(t, err)
+		assert.Equal(t, Entry[int]{Value: 1}, entry)
+
+		entry, err = swr.GetOrLoad(context.Background(), "key", load)
+		require.NoError(t, err)
+		assert.Equal(t, 1, entry.Value)
+		assert.False(t, entry.Stale)
+		assert.Equal(t, int32(1), loads.Load())
+	})
+
+	t.Run("returns stale value right away and refreshes in the background", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		swr := newSWR(clock)
+		release := make(chan struct{})
+		var loads atomic.Int32
+		load := func(ctx context.Context) (int, error) {
+			if loads.Add(1) > 1 {
+				<-release
+			}
+			return int(loads.Load()), nil
+		}
+
+		swr.GetOrLoad(context.Background(), "key", load)
+		clock.Advance(10 * time.Second)
+
+		entry, err := swr.GetOrLoad(context.Background(), "key", load)
+		require.NoError(t, err)
+		assert.Equal(t, Entry[int]{Value: 1, Age: 10 * time.Second, Stale: true}, entry)
+
+		// a refresh is already running, no need for another one
+		swr.GetOrLoad(context.Background(), "key", load)
+		close(release)
+
+		assert.Eventually(t, func() bool {
+			entry, _ := swr.GetOrLoad(context.Background(), "key", load)
+			return !entry.Stale && entry.Value == 2
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, int32(2), loads.Load())
+	})
+
+	t.Run("background refresh is not cancelled with the request", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		swr := newSWR(clock)
+		refreshed := make(chan error, 1)
+
+		swr.GetOrLoad(context.Background(), "key", func(ctx context.Context) (int, error) { return 1, nil })
+		clock.Advance(10 * time.Second)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		swr.GetOrLoad(ctx, "key", func(ctx context.Context) (int, error) {
+			<-time.After(10 * time.Millisecond)
+			refreshed <- ctx.Err()
+			return 2, nil
+		})
+		cancel()
+
+		assert.NoError(t, <-refreshed)
+	})
+
+	t.Run("serves stale value when refresh fails until the hard ttl", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		swr := newSWR(clock)
+		failed := make(chan struct{}, 1)
+		failing := func(ctx context.Context) (int, error) {
+			defer func() { failed <- struct{}{} }()
+			return 0, errors.New("sl is down")
+		}
+
+		swr.GetOrLoad(context.Background(), "key", func(ctx context.Context) (int, error) { return 1, nil })
+		clock.Advance(10 * time.Second)
+
+		entry, err := swr.GetOrLoad(context.Background(), "key", failing)
+		require.NoError(t, err)
+		assert.Equal(t, 1, entry.Value)
+		<-failed
+
+		clock.Advance(40 * time.Second)
+		entry, err = swr.GetOrLoad(context.Background(), "key", failing)
+		require.NoError(t, err)
+		assert.Equal(t, 1, entry.Value)
+		assert.Equal(t, 50*time.Second, entry.Age)
+		<-failed
+
+		clock.Advance(11 * time.Second)
+		_, err = swr.GetOrLoad(context.Background(), "key", failing)
+		assert.Error(t, err)
+	})
+}
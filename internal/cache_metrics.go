@@ -0,0 +1,42 @@
+package gosltimetable
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/metrics"
+)
+
+// collectCacheMetrics turns the stats of every cache from router.caches
+// into metric families labelled with the cache name
+func (router *Router) collectCacheMetrics() []metrics.Family {
+	caches := router.caches()
+
+	families := []metrics.Family{
+		{Name: "cache_hits_total", Help: "Cache lookups that found a value", Type: metrics.TypeCounter},
+		{Name: "cache_misses_total", Help: "Cache lookups that found nothing or an expired value", Type: metrics.TypeCounter},
+		{Name: "cache_sets_total", Help: "Values written to the cache", Type: metrics.TypeCounter},
+		{Name: "cache_expirations_total", Help: "Entries removed after their ttl", Type: metrics.TypeCounter},
+		{Name: "cache_evictions_total", Help: "Entries evicted because the cache was full", Type: metrics.TypeCounter},
+		{Name: "cache_entries", Help: "Current number of entries in the cache", Type: metrics.TypeGauge},
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(caches)) {
+		stats := caches[name].Stats()
+		labels := []metrics.Label{{Name: "cache", Value: name}}
+
+		values := []float64{
+			float64(stats.Hits),
+			float64(stats.Misses),
+			float64(stats.Sets),
+			float64(stats.Expirations),
+			float64(stats.Evictions),
+			float64(stats.Entries),
+		}
+		for i, value := range values {
+			families[i].Samples = append(families[i].Samples, metrics.Sample{Labels: labels, Value: value})
+		}
+	}
+
+	return families
+}
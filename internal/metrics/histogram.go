@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets in seconds, tuned for http calls that time out after 10s
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	labels []Label
+	// counts per bucket, not cumulative, that's done when collecting
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a histogram per combination of label values
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    slices.Sorted(slices.Values(buckets)),
+		histograms: map[string]*histogram{},
+	}
+}
+
+// Observe adds value to the histogram for labelValues, given in the same
+// order as the label names
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, found := h.histograms[key]
+	if !found {
+		labels := make([]Label, len(h.labelNames))
+		for i, name := range h.labelNames {
+			if i < len(labelValues) {
+				labels[i] = Label{name, labelValues[i]}
+			} else {
+				labels[i] = Label{Name: name}
+			}
+		}
+		hist = &histogram{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = hist
+	}
+
+	if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.sum += value
+	hist.count++
+}
+
+func (h *HistogramVec) Collect() []Family {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	family := Family{Name: h.name, Help: h.help, Type: TypeHistogram}
+	for _, key := range keys {
+		hist := h.histograms[key]
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			family.Samples = append(family.Samples, Sample{
+				Suffix: "_bucket",
+				Labels: withLabel(hist.labels, "le", formatValue(upper)),
+				Value:  float64(cumulative),
+			})
+		}
+		family.Samples = append(family.Samples,
+			Sample{Suffix: "_bucket", Labels: withLabel(hist.labels, "le", formatValue(math.Inf(1))), Value: float64(hist.count)},
+			Sample{Suffix: "_sum", Labels: hist.labels, Value: hist.sum},
+			Sample{Suffix: "_count", Labels: hist.labels, Value: float64(hist.count)},
+		)
+	}
+
+	return []Family{family}
+}
+
+func withLabel(labels []Label, name string, value string) []Label {
+	return append(slices.Clone(labels), Label{name, value})
+}
@@ -0,0 +1,115 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/metrics"
+	"github.com/alexdriaguine/go-sl-time-table/internal/metrics/metricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Run("writes counters and gauges", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		registry.Register(metrics.CollectorFunc(func() []metrics.Family {
+			return []metrics.Family{
+				{
+					Name: "requests_total",
+					Help: "Requests\nhandled",
+					Type: metrics.TypeCounter,
+					Samples: []metrics.Sample{
+						{Labels: []metrics.Label{{Name: "path", Value: `/a "quoted" \ path`}}, Value: 3},
+						{Labels: []metrics.Label{{Name: "path", Value: "/b"}}, Value: 1.5},
+					},
+				},
+				{Name: "up", Help: "Is it up", Type: metrics.TypeGauge, Samples: []metrics.Sample{{Value: 1}}},
+			}
+		}))
+
+		var buf bytes.Buffer
+		require.NoError(t, registry.WriteText(&buf))
+
+		parsed, err := metricstest.Parse(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, "counter", parsed.Types["requests_total"])
+		assert.Equal(t, "gauge", parsed.Types["up"])
+		assert.Equal(t, `Requests\nhandled`, parsed.Help["requests_total"])
+		assert.Equal(t, map[string]float64{
+			`requests_total{path="/a \"quoted\" \\ path"}`: 3,
+			`requests_total{path="/b"}`:                    1.5,
+			`up`:                                           1,
+		}, parsed.Values)
+	})
+
+	t.Run("families with the same name are merged", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		for _, value := range []string{"a", "b"} {
+			registry.Register(metrics.CollectorFunc(func() []metrics.Family {
+				return []metrics.Family{{
+					Name:    "things",
+					Type:    metrics.TypeGauge,
+					Samples: []metrics.Sample{{Labels: []metrics.Label{{Name: "name", Value: value}}, Value: 1}},
+				}}
+			}))
+		}
+
+		var buf bytes.Buffer
+		registry.WriteText(&buf)
+
+		assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("# TYPE things gauge")))
+
+		parsed, err := metricstest.Parse(&buf)
+		require.NoError(t, err)
+		assert.Len(t, parsed.Values, 2)
+	})
+
+	t.Run("handler serves text format", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+
+		response := httptest.NewRecorder()
+		registry.Handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", response.Header().Get("content-type"))
+	})
+}
+
+func TestHistogramVec(t *testing.T) {
+	histogram := metrics.NewHistogramVec("latency_seconds", "Latency", []float64{0.1, 1, 0.5}, "endpoint")
+
+	histogram.Observe(0.05, "sites")
+	histogram.Observe(0.1, "sites")
+	histogram.Observe(0.7, "sites")
+	histogram.Observe(3, "sites")
+	histogram.Observe(0.2, "departures")
+
+	registry := metrics.NewRegistry()
+	registry.Register(histogram)
+
+	var buf bytes.Buffer
+	registry.WriteText(&buf)
+
+	parsed, err := metricstest.Parse(&buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, "histogram", parsed.Types["latency_seconds"])
+	assert.Equal(t, map[string]float64{
+		`latency_seconds_bucket{endpoint="sites",le="0.1"}`:       2,
+		`latency_seconds_bucket{endpoint="sites",le="0.5"}`:       2,
+		`latency_seconds_bucket{endpoint="sites",le="1"}`:         3,
+		`latency_seconds_bucket{endpoint="sites",le="+Inf"}`:      4,
+		`latency_seconds_sum{endpoint="sites"}`:                   3.85,
+		`latency_seconds_count{endpoint="sites"}`:                 4,
+		`latency_seconds_bucket{endpoint="departures",le="0.1"}`:  0,
+		`latency_seconds_bucket{endpoint="departures",le="0.5"}`:  1,
+		`latency_seconds_bucket{endpoint="departures",le="1"}`:    1,
+		`latency_seconds_bucket{endpoint="departures",le="+Inf"}`: 1,
+		`latency_seconds_sum{endpoint="departures"}`:              0.2,
+		`latency_seconds_count{endpoint="departures"}`:            1,
+	}, parsed.Values)
+}
@@ -0,0 +1,59 @@
+// Package metricstest parses the prometheus text format back so tests
+// can assert on values instead of comparing strings
+package metricstest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Parsed struct {
+	// by family name
+	Types map[string]string
+	Help  map[string]string
+	// by series, the full name with labels as written, like
+	// cache_hits_total{cache="sites"}
+	Values map[string]float64
+}
+
+func Parse(r io.Reader) (Parsed, error) {
+	parsed := Parsed{
+		Types:  map[string]string{},
+		Help:   map[string]string{},
+		Values: map[string]float64{},
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "# HELP "):
+			name, help, _ := strings.Cut(strings.TrimPrefix(line, "# HELP "), " ")
+			parsed.Help[name] = help
+		case strings.HasPrefix(line, "# TYPE "):
+			name, typ, _ := strings.Cut(strings.TrimPrefix(line, "# TYPE "), " ")
+			parsed.Types[name] = typ
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			// label values can contain spaces, the value is after the last one
+			i := strings.LastIndex(line, " ")
+			if i < 0 {
+				return parsed, fmt.Errorf("line %d: no value in %q", lineNumber, line)
+			}
+			value, err := strconv.ParseFloat(line[i+1:], 64)
+			if err != nil {
+				return parsed, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			parsed.Values[line[:i]] = value
+		}
+	}
+
+	return parsed, scanner.Err()
+}
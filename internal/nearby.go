@@ -0,0 +1,192 @@
+package gosltimetable
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+
+	v1 "github.com/alexdriaguine/go-sl-time-table/internal/api/v1"
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+)
+
+// in metres, about a five minute walk
+const nearbyDefaultRadius = 500
+const nearbyMaxRadius = 5000
+
+const nearbyDefaultLimit = 10
+const nearbyMaxLimit = 50
+
+// how many of the closest sites nearby departures are from, unless asked
+// for with ?sites=
+const nearbyDefaultSites = 5
+
+// walking somewhere is about this much longer than the straight line
+const walkingDetour = 1.3
+
+// parseNearbyFromQuery reads ?lat=&lon=&radius=, lat and lon are needed
+// and radius has a default. How many sites is read from the limitName
+// param
+func parseNearbyFromQuery(url *url.URL, limitName string, defaultLimit int, maxLimit int) (sl_api.GetNearbySitesArgs, error) {
+	var args sl_api.GetNearbySitesArgs
+	var err error
+
+	for _, name := range []string{"lat", "lon"} {
+		if url.Query().Get(name) == "" {
+			return args, invalidParam(name, fmt.Sprintf("%s is needed", name))
+		}
+	}
+
+	if args.Lat, err = parseFloatFromQuery(url, "lat"); err != nil {
+		return args, err
+	}
+	if args.Lat < -90 || args.Lat > 90 {
+		return args, invalidParam("lat", "lat can be -90 to 90")
+	}
+	if args.Lon, err = parseFloatFromQuery(url, "lon"); err != nil {
+		return args, err
+	}
+	if args.Lon < -180 || args.Lon > 180 {
+		return args, invalidParam("lon", "lon can be -180 to 180")
+	}
+
+	if args.Radius, err = parseFloatFromQuery(url, "radius"); err != nil {
+		return args, err
+	}
+	if args.Radius == 0 {
+		args.Radius = nearbyDefaultRadius
+	}
+	if args.Radius < 0 || args.Radius > nearbyMaxRadius {
+		return args, invalidParam("radius", fmt.Sprintf("radius can be 1 to %d metres", nearbyMaxRadius))
+	}
+
+	if args.Limit, err = parseIntFromQuery(url, limitName); err != nil {
+		return args, err
+	}
+	if args.Limit == 0 {
+		args.Limit = defaultLimit
+	}
+	if args.Limit < 1 || args.Limit > maxLimit {
+		return args, invalidParam(limitName, fmt.Sprintf("%s can be 1 to %d", limitName, maxLimit))
+	}
+
+	return args, nil
+}
+
+// handleNearbySites answers with the sites around ?lat=&lon=, closest
+// first with the distance in metres
+func (router *Router) handleNearbySites(w http.ResponseWriter, r *http.Request) {
+	args, err := parseNearbyFromQuery(r.URL, "limit", nearbyDefaultLimit, nearbyMaxLimit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	sites, err := router.slClient.GetNearbySites(r.Context(), args)
+	if err != nil {
+		log.Printf("error getting sites near %f,%f, %v", args.Lat, args.Lon, err)
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(v1.MapNearbySites(sites))
+}
+
+// handleNearbyDepartures is a board for the sites closest to ?lat=&lon=,
+// ?sites= of them and at most boardMaxSites. It takes the same filters as
+// the departures of a site
+func (router *Router) handleNearbyDepartures(w http.ResponseWriter, r *http.Request) {
+	nearbyArgs, err := parseNearbyFromQuery(r.URL, "sites", nearbyDefaultSites, boardMaxSites)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	filters, err := parseFiltersFromQuery(r.URL)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// checked before looking for sites, bad filters are bad with no
+	// sites nearby too
+	siteArgs, err := departuresArgs(filters, 0)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	sites, err := router.slClient.GetNearbySites(r.Context(), nearbyArgs)
+	if err != nil {
+		log.Printf("error getting sites near %f,%f, %v", nearbyArgs.Lat, nearbyArgs.Lon, err)
+		writeError(w, r, err)
+		return
+	}
+
+	args := make([]sl_api.GetDeparturesArgs, len(sites))
+	for i, site := range sites {
+		args[i] = siteArgs
+		args[i].SiteId = site.Site.Id
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(router.buildNearbyBoard(r, sites, args))
+}
+
+// buildNearbyBoard is buildBoard for nearby sites, sites and args are in
+// the same order, closest first
+func (router *Router) buildNearbyBoard(r *http.Request, sites []sl_api.NearbySite, args []sl_api.GetDeparturesArgs) v1.NearbyBoardResponse {
+	departures, boardSites := router.fetchBoard(r, args)
+
+	board := v1.NearbyBoardResponse{Departures: []v1.NearbyDeparture{}, Sites: []v1.NearbyBoardSite{}}
+	byId := map[int]v1.NearbyBoardSite{}
+	for i, site := range sites {
+		nearbySite := v1.NearbyBoardSite{
+			BoardSite:       boardSites[i],
+			Name:            site.Site.Name,
+			Distance:        int(math.Round(site.Distance)),
+			WalkingDistance: walkingDistance(site.Distance),
+		}
+		byId[site.Site.Id] = nearbySite
+		board.Sites = append(board.Sites, nearbySite)
+	}
+
+	// sites next to each other can share stop areas, the same journey at
+	// the same stop area is then kept for the closest of them. A journey
+	// stopping at different stop areas is kept at each. 0 is a journey sl
+	// didn't send an id for
+	type journeyStop struct {
+		journey  int64
+		stopArea int
+	}
+	closest := map[journeyStop]int{}
+	for _, d := range departures {
+		stop := journeyStop{d.departure.Journey.Id, d.departure.StopArea.Id}
+		if current, found := closest[stop]; stop.journey != 0 && (!found || byId[d.siteId].Distance < byId[current].Distance) {
+			closest[stop] = d.siteId
+		}
+	}
+
+	for _, d := range departures {
+		if stop := (journeyStop{d.departure.Journey.Id, d.departure.StopArea.Id}); stop.journey != 0 && closest[stop] != d.siteId {
+			continue
+		}
+
+		site := byId[d.siteId]
+		board.Departures = append(board.Departures, v1.NearbyDeparture{
+			SiteId:          d.siteId,
+			SiteName:        site.Name,
+			WalkingDistance: site.WalkingDistance,
+			Departure:       v1.MapDeparture(d.departure),
+		})
+	}
+
+	return board
+}
+
+func walkingDistance(distance float64) int {
+	return int(math.Round(distance * walkingDetour))
+}
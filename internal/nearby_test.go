@@ -0,0 +1,128 @@
+package gosltimetable_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gosltimetable "github.com/alexdriaguine/go-sl-time-table/internal"
+	v1 "github.com/alexdriaguine/go-sl-time-table/internal/api/v1"
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func journeyAt(destination string, minutes int, journey int64, stopArea int) sl_api.MappedSLDeparture {
+	departure := departureAt(destination, minutes)
+	departure.Journey.Id = journey
+	departure.StopArea.Id = stopArea
+	return departure
+}
+
+func TestNearbyDepartures(t *testing.T) {
+	setup := func() (*gosltimetable.Router, *slApiClientStub) {
+		slApiMock := buildSitesStub(map[int][]sl_api.MappedSLDeparture{
+			// journey 10 is at stop area 100, which both Odenplan sites
+			// have. Journey 30 stops at a stop area of each
+			1: {journeyAt("Ropsten", 5, 10, 100), journeyAt("Fridhemsplan", 1, 11, 100), journeyAt("Hornsberg", 7, 30, 100)},
+			2: {journeyAt("Ropsten", 5, 10, 100), journeyAt("Karolinska", 3, 20, 200), journeyAt("Unknown", 4, 0, 200), journeyAt("Hornsberg", 9, 30, 200)},
+		})
+		slApiMock.nearby = []sl_api.NearbySite{
+			{Site: sl_api.MappedSLSite{Id: 1, Name: "Odenplan"}, Distance: 100},
+			{Site: sl_api.MappedSLSite{Id: 2, Name: "Odenplan buss"}, Distance: 250.4},
+			{Site: sl_api.MappedSLSite{Id: 3, Name: "Vasaparken"}, Distance: 400},
+		}
+		router, _ := gosltimetable.NewRouter(slApiMock)
+		return router, slApiMock
+	}
+
+	t.Run("merges the nearby sites and keeps a journey at a shared stop area for the closest site", func(t *testing.T) {
+		router, slApiMock := setup()
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/departures/nearby?lat=59.3429&lon=18.0496&radius=800"))
+		board := decodeJSON[v1.NearbyBoardResponse](t, response)
+
+		got := []string{}
+		for _, d := range board.Departures {
+			got = append(got, fmt.Sprintf("%s@%s/%d", d.Destination, d.SiteName, d.WalkingDistance))
+		}
+		assert.Equal(t, []string{
+			"Fridhemsplan@Odenplan/130",
+			"Karolinska@Odenplan buss/326",
+			"Unknown@Odenplan buss/326",
+			"Ropsten@Odenplan/130",
+			"Hornsberg@Odenplan/130",
+			"Hornsberg@Odenplan buss/326",
+		}, got)
+		assert.Equal(t, sl_api.GetNearbySitesArgs{Lat: 59.3429, Lon: 18.0496, Radius: 800, Limit: 5}, slApiMock.lastNearbyArgs)
+	})
+
+	t.Run("sites are closest first with how it went for each", func(t *testing.T) {
+		router, _ := setup()
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/departures/nearby?lat=59.3429&lon=18.0496"))
+		board := decodeJSON[v1.NearbyBoardResponse](t, response)
+
+		assert.Equal(t, []v1.NearbyBoardSite{
+			{BoardSite: v1.BoardSite{SiteId: 1}, Name: "Odenplan", Distance: 100, WalkingDistance: 130},
+			{BoardSite: v1.BoardSite{SiteId: 2}, Name: "Odenplan buss", Distance: 250, WalkingDistance: 326},
+			{
+				BoardSite: v1.BoardSite{SiteId: 3, Code: "upstream_unavailable", Error: "SL is unavailable"},
+				Name:      "Vasaparken", Distance: 400, WalkingDistance: 520,
+			},
+		}, board.Sites)
+	})
+
+	t.Run("filters apply to every site", func(t *testing.T) {
+		router, slApiMock := setup()
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/departures/nearby?lat=59.3429&lon=18.0496&sites=2&transport=bus&limit=1"))
+
+		require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+		assert.Equal(t, 2, slApiMock.lastNearbyArgs.Limit)
+		assert.Equal(t, []sl_api.TransportType{sl_api.TransportBus}, slApiMock.lastArgs.Transports)
+		assert.Equal(t, 1, slApiMock.lastArgs.Limit)
+	})
+
+	t.Run("no sites nearby is an empty board", func(t *testing.T) {
+		router, slApiMock := setup()
+		slApiMock.nearby = []sl_api.NearbySite{}
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/departures/nearby?lat=0&lon=0"))
+
+		require.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"Departures": [], "Sites": []}`, response.Body.String())
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		router, slApiMock := setup()
+		slApiMock.nearby = []sl_api.NearbySite{}
+
+		cases := map[string]string{
+			"/api/v1/departures/nearby?lon=18.05":                        "invalid_lat",
+			"/api/v1/departures/nearby?lat=59.33&lon=18.05&sites=11":     "invalid_sites",
+			"/api/v1/departures/nearby?lat=0&lon=0&transport=rocket":     "invalid_transport",
+			"/api/v1/departures/nearby?lat=59.33&lon=18.05&minMinutes=x": "invalid_min_minutes",
+		}
+
+		for path, code := range cases {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, newGetRequest(path))
+			assertProblem(t, response, http.StatusBadRequest, code, path)
+		}
+	})
+
+	t.Run("sl errors finding sites are returned", func(t *testing.T) {
+		router, slApiMock := setup()
+		slApiMock.err = fmt.Errorf("wrapped, %w", sl_api.ErrUpstreamUnavailable)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/departures/nearby?lat=59.33&lon=18.05"))
+		assertProblem(t, response, http.StatusServiceUnavailable, "upstream_unavailable")
+	})
+}
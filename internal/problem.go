@@ -0,0 +1,169 @@
+package gosltimetable
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+)
+
+// Problem is an rfc 7807 problem details response. Clients should look
+// at Code, Detail is for humans and can change
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// the path that was asked for
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	// the query or path parameter that was wrong, if any
+	Param     string `json:"param,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	if p.Param != "" {
+		return fmt.Sprintf("%s (%s), %s", p.Code, p.Param, p.Detail)
+	}
+	return fmt.Sprintf("%s, %s", p.Code, p.Detail)
+}
+
+func newProblem(status int, code string, detail string) *Problem {
+	return &Problem{Status: status, Code: code, Detail: detail}
+}
+
+// invalidParam is a 400 for a bad value in param, the code is
+// invalid_ followed by the param in snake case
+func invalidParam(param string, detail string) *Problem {
+	return &Problem{Status: http.StatusBadRequest, Code: "invalid_" + snakeCase(param), Param: param, Detail: detail}
+}
+
+var upperCase = regexp.MustCompile(`[A-Z]`)
+
+func snakeCase(value string) string {
+	return upperCase.ReplaceAllStringFunc(value, func(upper string) string {
+		return "_" + strings.ToLower(upper)
+	})
+}
+
+// upstreamProblem maps errors from the sl client to a problem that is
+// safe to show, the wrapped error can contain urls and response bodies
+// from sl so it's only logged
+func upstreamProblem(err error) *Problem {
+	switch {
+	case errors.Is(err, sl_api.ErrInvalidTransportType):
+		return invalidParam("transport", "Unknown transport")
+	case errors.Is(err, sl_api.ErrSiteNotFound):
+		return newProblem(http.StatusNotFound, "site_not_found", "Site not found")
+	case errors.Is(err, sl_api.ErrRateLimited):
+		return newProblem(http.StatusTooManyRequests, "rate_limited", "Too many requests to SL, try again later")
+	case errors.Is(err, sl_api.ErrUpstreamUnavailable):
+		return newProblem(http.StatusServiceUnavailable, "upstream_unavailable", "SL is unavailable")
+	case errors.Is(err, sl_api.ErrUpstreamMalformed):
+		return newProblem(http.StatusBadGateway, "upstream_malformed", "Unexpected response from SL")
+	default:
+		return newProblem(http.StatusInternalServerError, "internal_error", "Internal Server Error")
+	}
+}
+
+// writeError is how every handler answers with an error. A *Problem
+// anywhere in err is written as is, anything else goes through
+// upstreamProblem
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var problem *Problem
+	if errors.As(err, &problem) {
+		copied := *problem
+		problem = &copied
+	} else {
+		problem = upstreamProblem(err)
+	}
+
+	problem.Type = "about:blank"
+	problem.Title = http.StatusText(problem.Status)
+	problem.Instance = r.URL.Path
+	problem.RequestId = requestIdFrom(r.Context())
+
+	w.Header().Set("content-type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+type requestIdKey struct{}
+
+// a request id from a proxy in front of us is kept if it looks sane
+var validRequestId = regexp.MustCompile(`^[0-9A-Za-z._-]{1,64}$`)
+
+// withRequestId gives every request an id, sent back in the x-request-id
+// header and in problems so a user's error can be found in the logs
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("x-request-id")
+		if !validRequestId.MatchString(id) {
+			id = newRequestId()
+		}
+
+		w.Header().Set("x-request-id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// withApiProblems answers /api paths the mux has no route for with a
+// problem instead of the mux's plain text. The mux only knows the
+// method is wrong when no pattern matches the path for any method, and
+// the static files match every GET, so which methods are allowed is
+// worked out by asking the mux
+func withApiProblems(mux *http.ServeMux) http.Handler {
+	methods := []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+	isApiRoute := func(r *http.Request) bool {
+		_, pattern := mux.Handler(r)
+		return pattern != "" && pattern != "GET /"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || isApiRoute(r) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		var allowed []string
+		for _, method := range methods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if isApiRoute(probe) {
+				allowed = append(allowed, method)
+			}
+		}
+
+		if len(allowed) == 0 {
+			writeError(w, r, newProblem(http.StatusNotFound, "not_found", "No such endpoint"))
+			return
+		}
+
+		if slices.Contains(allowed, http.MethodGet) {
+			allowed = append(allowed, http.MethodHead)
+		}
+		w.Header().Set("allow", strings.Join(allowed, ", "))
+		writeError(w, r, newProblem(http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("%s is not allowed here", r.Method)))
+	})
+}
@@ -1,40 +1,73 @@
 package gosltimetable
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
+	v1 "github.com/alexdriaguine/go-sl-time-table/internal/api/v1"
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache"
+	"github.com/alexdriaguine/go-sl-time-table/internal/metrics"
 	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
 )
 
 //go:embed "static/*"
 var staticFiles embed.FS
 
-type ErrorResponse struct {
-	Message string
-}
-
 type Router struct {
 	http.Handler
-	slClient sl_api.SLClient
+	slClient       sl_api.SLClient
+	lastDepartures *cache.InMemoryCache[string, sl_api.DeparturesResult]
+	clock          cache.Clock
+}
+
+type RouterOption func(*Router)
+
+// WithClock is what the last known departures are counted down from,
+// and what they age by
+func WithClock(clock cache.Clock) RouterOption {
+	return func(router *Router) {
+		router.clock = clock
+	}
+}
+
+type HealthResponse struct {
+	Status   string
+	Upstream sl_api.Health
 }
 
-func NewRouter(slClient sl_api.SLClient) (*Router, error) {
+// how long we keep the last successful departures around to serve
+// while the circuit to sl is open. Older than this and they're not
+// worth showing anyway
+const lastDeparturesTTL = 15 * time.Minute
+const lastDeparturesMaxEntries = 1000
+
+func NewRouter(slClient sl_api.SLClient, opts ...RouterOption) (*Router, error) {
 
 	isDev := os.Getenv("IS_DEV") == "true"
 
-	router := &Router{}
+	router := &Router{clock: cache.SystemClock{}}
 	router.slClient = slClient
+	for _, opt := range opts {
+		opt(router)
+	}
+	router.lastDepartures = cache.NewCache(
+		cache.WithMaxEntries[string, sl_api.DeparturesResult](lastDeparturesMaxEntries),
+		cache.WithClock[string, sl_api.DeparturesResult](router.clock),
+	)
 	handler := http.NewServeMux()
 
 	if !isDev {
@@ -48,124 +81,406 @@ func NewRouter(slClient sl_api.SLClient) (*Router, error) {
 		// converts our filesustem to a http handler
 		fileServer := http.FileServerFS(staticFs)
 
-		handler.Handle("/", fileServer)
+		handler.Handle("GET /", fileServer)
 
 	}
 
-	handler.Handle("/api/departures/", http.HandlerFunc(router.handleDepartures))
-	handler.Handle("/api/sites", http.HandlerFunc(router.handleSites))
-	router.Handler = handler
+	handler.Handle("GET /api/v1/sites/{id}/departures", http.HandlerFunc(router.handleDepartures))
+	handler.Handle("GET /api/v1/sites", http.HandlerFunc(router.handleSites))
+	handler.Handle("GET /api/v1/sites/{id}", http.HandlerFunc(router.handleSite))
+	handler.Handle("GET /api/v1/sites/nearby", http.HandlerFunc(router.handleNearbySites))
+	handler.Handle("GET /api/v1/departures/nearby", http.HandlerFunc(router.handleNearbyDepartures))
+	handler.Handle("GET /api/v1/boards", http.HandlerFunc(router.handleGetBoard))
+	handler.Handle("POST /api/v1/boards", http.HandlerFunc(router.handlePostBoard))
+	handler.Handle("GET /api/health", http.HandlerFunc(router.handleHealth))
+
+	// the routes from before /api/v1, they answer with the v1 models
+	handler.Handle("GET /api/departures/{id}", deprecated("/api/v1/sites/{id}/departures", router.handleDepartures))
+	handler.Handle("GET /api/sites", deprecated("/api/v1/sites", router.handleSites))
+	handler.Handle("GET /api/boards", deprecated("/api/v1/boards", router.handleGetBoard))
+	handler.Handle("POST /api/boards", deprecated("/api/v1/boards", router.handlePostBoard))
+	// newer routes are only in v1, the nearby ones would otherwise be taken
+	// for a site id
+	handler.Handle("GET /api/sites/{id}", onlyInV1("/api/v1/sites/{id}"))
+	handler.Handle("GET /api/sites/nearby", onlyInV1("/api/v1/sites/nearby"))
+	handler.Handle("GET /api/departures/nearby", onlyInV1("/api/v1/departures/nearby"))
+	router.registerAdmin(handler, os.Getenv("ADMIN_TOKEN"))
+
+	registry := metrics.NewRegistry()
+	registry.Register(metrics.CollectorFunc(router.collectCacheMetrics))
+	// the sl client only has metrics if it's talking to sl, not in tests
+	if collector, ok := slClient.(metrics.Collector); ok {
+		registry.Register(collector)
+	}
+	handler.Handle("GET /metrics", registry.Handler())
+	router.Handler = withRequestId(withApiProblems(handler))
 
 	return router, nil
 }
 
-func (router *Router) handleDepartures(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("content-type", "application/json")
+// deprecated marks a response from an old route with the Deprecation
+// header and links to the route that replaced it, {id} in successor is
+// filled in from the request
+func deprecated(successor string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		link := strings.ReplaceAll(successor, "{id}", url.PathEscape(r.PathValue("id")))
+
+		w.Header().Add("deprecation", "true")
+		w.Header().Add("link", fmt.Sprintf("<%s>; rel=\"successor-version\"", link))
+		next(w, r)
+	})
+}
 
-	siteId, siteIdErr := parseSiteIdFromUrl(r.URL)
-	line, lineErr := parseLineFromQuery(r.URL)
-	direction, directionErr := parseDirectionFromQuery(r.URL)
-	transport := strings.ToUpper(r.URL.Query().Get("transport"))
+// onlyInV1 is a 404 for an old style path to a route that is only in v1,
+// saying where it is
+func onlyInV1(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.ReplaceAll(path, "{id}", url.PathEscape(r.PathValue("id")))
+		writeError(w, r, newProblem(http.StatusNotFound, "not_found", fmt.Sprintf("No such endpoint, use %s", path)))
+	})
+}
 
-	if siteIdErr != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Message: siteIdErr.Error()})
+func (router *Router) handleDepartures(w http.ResponseWriter, r *http.Request) {
+	siteId, err := parseSiteId(r)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	if lineErr != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Message: lineErr.Error()})
+	filters, err := parseFiltersFromQuery(r.URL)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	if directionErr != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Message: directionErr.Error()})
+	include, err := parseIncludeFromQuery(r.URL)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	args := sl_api.GetDeparturesArgs{
-		SiteId:    siteId,
-		Line:      line,
-		Transport: sl_api.TransportType(transport),
-		Direction: direction,
+	args, err := departuresArgs(filters, siteId)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
 
-	departures, err := router.slClient.GetDepartures(args)
-
+	departures, err := router.getDepartures(r.Context(), args)
 	if err != nil {
 		log.Printf("error getting departures from sl, %v", err)
+		writeError(w, r, err)
+		return
+	}
 
-		if errors.Is(err, sl_api.ErrInvalidTransportType) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(ErrorResponse{Message: err.Error()})
-			return
+	w.Header().Add("content-type", "application/json")
+	writeDepartures(w, departures, include)
+}
+
+// getDepartures falls back to the last departures we got for args while
+// the circuit to sl is open, counted down again so a departure that has
+// left isn't shown as leaving soon
+func (router *Router) getDepartures(ctx context.Context, args sl_api.GetDeparturesArgs) (sl_api.DeparturesResult, error) {
+	departures, err := router.slClient.GetDepartures(ctx, args)
+	lastDeparturesKey := fmt.Sprintf(
+		"%d-%v-%v-%v-%d-%d-%d",
+		args.SiteId,
+		args.Lines,
+		args.Directions,
+		args.Transports,
+		args.MinMinutes,
+		args.MaxMinutes,
+		args.Limit,
+	)
+
+	if errors.Is(err, sl_api.ErrCircuitOpen) {
+		if last, found := router.lastDepartures.GetEntry(lastDeparturesKey); found {
+			stale := last.Value
+			stale.Departures = sl_api.Recount(stale.Departures, args, router.clock.Now())
+			stale.Age += last.Age
+			stale.Stale = true
+			return stale, nil
 		}
+	}
+
+	if err != nil {
+		return sl_api.DeparturesResult{}, err
+	}
 
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Message: "Internal Server Error"})
+	router.lastDepartures.Set(lastDeparturesKey, departures, lastDeparturesTTL)
+	return departures, nil
+}
+
+// writeDepartures keeps the body a plain list of departures unless the
+// stop deviations were asked for, how old they are goes in the Age
+// header (seconds) and stale departures get the x-stale header
+func writeDepartures(w http.ResponseWriter, departures sl_api.DeparturesResult, include includes) {
+	w.Header().Add("age", strconv.Itoa(int(departures.Age.Seconds())))
+	if departures.Stale {
+		w.Header().Add("x-stale", "true")
+	}
+
+	if !include.deviations {
+		json.NewEncoder(w).Encode(v1.MapDepartures(departures.Departures))
 		return
 	}
 
-	json.NewEncoder(w).Encode(departures)
+	json.NewEncoder(w).Encode(v1.DeparturesResponse{
+		Departures:     v1.MapDepartures(departures.Departures),
+		StopDeviations: v1.MapStopDeviations(departures.StopDeviations),
+	})
 }
 
-func (router *Router) handleSites(w http.ResponseWriter, r *http.Request) {
+// handleHealth always answers 200, we can still serve stale departures
+// and sites while sl is down so there's no point in taking us out of
+// rotation
+func (router *Router) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("content-type", "application/json")
+
+	health := router.slClient.Health()
+	status := "ok"
+	if health.Circuit != sl_api.BreakerClosed {
+		status = "degraded"
+	}
+
+	json.NewEncoder(w).Encode(HealthResponse{Status: status, Upstream: health})
+}
+
+// how many sites a search answers with, unless asked for with ?limit=
+const sitesDefaultLimit = 5
+const sitesMaxLimit = 50
+
+// handleSites answers with the sites matching ?term=, best match first.
+// Use ?offset= to get the next page
+func (router *Router) handleSites(w http.ResponseWriter, r *http.Request) {
 	searchTerm := r.URL.Query().Get("term")
 
 	if utf8.RuneCountInString(searchTerm) < 2 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Message: "2 or more characters needed for search"})
+		writeError(w, r, invalidParam("term", "2 or more characters needed for search"))
+		return
+	}
+
+	limit, err := parseIntFromQuery(r.URL, "limit")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if limit == 0 {
+		limit = sitesDefaultLimit
+	}
+	if limit < 1 || limit > sitesMaxLimit {
+		writeError(w, r, invalidParam("limit", fmt.Sprintf("limit can be 1 to %d", sitesMaxLimit)))
+		return
+	}
+
+	offset, err := parseIntFromQuery(r.URL, "offset")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if offset < 0 {
+		writeError(w, r, invalidParam("offset", "offset can't be negative"))
+		return
+	}
+
+	matchingSites, err := router.slClient.GetSites(r.Context(), searchTerm)
+
+	if err != nil {
+		log.Printf("error getting sites from sl, %v", err)
+		writeError(w, r, err)
 		return
 	}
 
-	matchingSites, _ := router.slClient.GetSites(searchTerm)
+	offset = min(offset, len(matchingSites))
+	matchingSites = matchingSites[offset:min(offset+limit, len(matchingSites))]
 
-	if len(matchingSites) > 5 {
-		matchingSites = matchingSites[:5]
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(v1.MapSites(matchingSites))
+}
+
+// handleSite is GET /api/v1/sites/{id}, it came after v1 so there's no
+// old style /api/sites/{id}
+func (router *Router) handleSite(w http.ResponseWriter, r *http.Request) {
+	siteId, err := parseSiteId(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	site, err := router.slClient.GetSite(r.Context(), siteId)
+	if err != nil {
+		if !errors.Is(err, sl_api.ErrSiteNotFound) {
+			log.Printf("error getting site %d from sl, %v", siteId, err)
+		}
+		writeError(w, r, err)
+		return
 	}
-	json.NewEncoder(w).Encode(matchingSites)
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(v1.MapSite(site))
 }
 
-func parseLineFromQuery(url *url.URL) (int, error) {
-	queryLine := url.Query().Get("line")
+// queryList reads a parameter given as ?name=a,b, ?name=a&name=b or
+// both, empty values are dropped
+func queryList(url *url.URL, name string) []string {
+	var values []string
 
-	if queryLine == "" {
+	for _, value := range url.Query()[name] {
+		for part := range strings.SplitSeq(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+
+	return values
+}
+
+// line designations are short and alphanumeric, "43", "43X" or "N1"
+var lineDesignation = regexp.MustCompile(`^[0-9A-Za-z]{1,8}$`)
+
+// departuresArgs validates the filters and turns them into args for siteId
+func departuresArgs(f v1.DepartureFilters, siteId int) (sl_api.GetDeparturesArgs, error) {
+	for _, line := range f.Lines {
+		if !lineDesignation.MatchString(line) {
+			return sl_api.GetDeparturesArgs{}, invalidParam("line", fmt.Sprintf("%q is not a line, expected a line like 43 or 43X", line))
+		}
+	}
+
+	for _, direction := range f.Directions {
+		if direction != 1 && direction != 2 {
+			return sl_api.GetDeparturesArgs{}, invalidParam("direction", fmt.Sprintf("%d is not a direction, expected 1 or 2", direction))
+		}
+	}
+
+	var transports []sl_api.TransportType
+	for _, value := range f.Transports {
+		transport, err := sl_api.ParseTransportType(value)
+		if err != nil {
+			return sl_api.GetDeparturesArgs{}, invalidParam("transport", fmt.Sprintf("%q is not a transport, expected bus, tram, metro, train, ferry, ship or taxi", value))
+		}
+		transports = append(transports, transport)
+	}
+
+	if f.MinMinutes < 0 {
+		return sl_api.GetDeparturesArgs{}, invalidParam("minMinutes", "minMinutes can't be negative")
+	}
+	if f.MaxMinutes < 0 {
+		return sl_api.GetDeparturesArgs{}, invalidParam("maxMinutes", "maxMinutes can't be negative")
+	}
+	if f.Limit < 0 {
+		return sl_api.GetDeparturesArgs{}, invalidParam("limit", "limit can't be negative")
+	}
+
+	if f.MaxMinutes != 0 && f.MaxMinutes < f.MinMinutes {
+		return sl_api.GetDeparturesArgs{}, invalidParam("maxMinutes", fmt.Sprintf("maxMinutes %d is less than minMinutes %d", f.MaxMinutes, f.MinMinutes))
+	}
+
+	return sl_api.GetDeparturesArgs{
+		SiteId:     siteId,
+		Lines:      f.Lines,
+		Directions: f.Directions,
+		Transports: transports,
+		MinMinutes: f.MinMinutes,
+		MaxMinutes: f.MaxMinutes,
+		Limit:      f.Limit,
+	}, nil
+}
+
+// parseFiltersFromQuery only fails on values that aren't numbers, the
+// rest is checked by departuresArgs
+func parseFiltersFromQuery(url *url.URL) (v1.DepartureFilters, error) {
+	filters := v1.DepartureFilters{
+		Lines:      queryList(url, "line"),
+		Transports: queryList(url, "transport"),
+	}
+
+	for _, queryDirection := range queryList(url, "direction") {
+		direction, err := strconv.Atoi(queryDirection)
+
+		if err != nil {
+			return v1.DepartureFilters{}, invalidParam("direction", fmt.Sprintf("%q is not a direction, expected 1 or 2", queryDirection))
+		}
+
+		filters.Directions = append(filters.Directions, direction)
+	}
+
+	var err error
+	if filters.MinMinutes, err = parseIntFromQuery(url, "minMinutes"); err != nil {
+		return v1.DepartureFilters{}, err
+	}
+	if filters.MaxMinutes, err = parseIntFromQuery(url, "maxMinutes"); err != nil {
+		return v1.DepartureFilters{}, err
+	}
+	if filters.Limit, err = parseIntFromQuery(url, "limit"); err != nil {
+		return v1.DepartureFilters{}, err
+	}
+
+	return filters, nil
+}
+
+func parseIntFromQuery(url *url.URL, name string) (int, error) {
+	queryValue := url.Query().Get(name)
+
+	if queryValue == "" {
 		return 0, nil
 	}
 
-	line, err := strconv.Atoi(queryLine)
+	value, err := strconv.Atoi(queryValue)
 
 	if err != nil {
-		return 0, fmt.Errorf("could not parse line from value %s, %w", queryLine, err)
+		return 0, invalidParam(name, fmt.Sprintf("%q is not a number", queryValue))
 	}
 
-	return line, nil
+	return value, nil
 }
 
-func parseDirectionFromQuery(url *url.URL) (int, error) {
-	queryDirection := url.Query().Get("direction")
+func parseFloatFromQuery(url *url.URL, name string) (float64, error) {
+	queryValue := url.Query().Get(name)
 
-	if queryDirection == "" {
+	if queryValue == "" {
 		return 0, nil
 	}
 
-	direction, err := strconv.Atoi(queryDirection)
+	value, err := strconv.ParseFloat(queryValue, 64)
 
-	if err != nil {
-		return 0, fmt.Errorf("could not parse direction from value %s, %w", queryDirection, err)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, invalidParam(name, fmt.Sprintf("%q is not a number", queryValue))
 	}
 
-	return direction, nil
+	return value, nil
+}
+
+// includes are the optional parts of a departures response
+type includes struct {
+	deviations bool
 }
 
-func parseSiteIdFromUrl(url *url.URL) (int, error) {
-	siteId, err := strconv.Atoi(strings.Replace(url.Path, "/api/departures/", "", 1))
+// parseIncludeFromQuery accepts ?include=a,b as well as ?include=a&include=b
+func parseIncludeFromQuery(url *url.URL) (includes, error) {
+	var include includes
+
+	for _, part := range queryList(url, "include") {
+		switch part {
+		case "deviations":
+			include.deviations = true
+		default:
+			return includes{}, invalidParam("include", fmt.Sprintf("%q can't be included, expected deviations", part))
+		}
+	}
+
+	return include, nil
+}
+
+func parseSiteId(r *http.Request) (int, error) {
+	siteId, err := strconv.Atoi(r.PathValue("id"))
 
 	if err != nil {
-		return 0, fmt.Errorf("could not parse url %s to siteId, %w", url, err)
+		return 0, &Problem{
+			Status: http.StatusBadRequest,
+			Code:   "invalid_site_id",
+			Param:  "id",
+			Detail: fmt.Sprintf("%q is not a site id", r.PathValue("id")),
+		}
 	}
 
 	return siteId, nil
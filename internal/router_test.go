@@ -1,15 +1,23 @@
 package gosltimetable_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	gosltimetable "github.com/alexdriaguine/go-sl-time-table/internal"
+	v1 "github.com/alexdriaguine/go-sl-time-table/internal/api/v1"
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache"
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache/cachetest"
+	"github.com/alexdriaguine/go-sl-time-table/internal/metrics/metricstest"
 	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -17,25 +25,82 @@ var (
 )
 
 type slApiClientStub struct {
-	departures []sl_api.MappedSLDeparture
-	sites      []sl_api.MappedSLSite
-	err        error
+	departures     []sl_api.MappedSLDeparture
+	stopDeviations []sl_api.MappedSLStopDeviation
+	sites          []sl_api.MappedSLSite
+	err            error
+	health         sl_api.Health
+	age            time.Duration
+	stale          bool
+	caches         map[string]cache.Admin
+	// per site answers, for sites other than siteIdExists
+	siteDepartures map[int][]sl_api.MappedSLDeparture
+	siteErrs       map[int]error
+	nearby         []sl_api.NearbySite
+
+	mu             sync.Mutex
+	lastArgs       sl_api.GetDeparturesArgs
+	lastNearbyArgs sl_api.GetNearbySitesArgs
 }
 
-func (s *slApiClientStub) GetDepartures(args sl_api.GetDeparturesArgs) ([]sl_api.MappedSLDeparture, error) {
+func (s *slApiClientStub) GetDepartures(ctx context.Context, args sl_api.GetDeparturesArgs) (sl_api.DeparturesResult, error) {
+	s.mu.Lock()
+	s.lastArgs = args
+	s.mu.Unlock()
+
 	if s.err != nil {
-		return nil, s.err
+		return sl_api.DeparturesResult{}, s.err
+	}
+	if err, found := s.siteErrs[args.SiteId]; found {
+		return sl_api.DeparturesResult{}, err
+	}
+	if departures, found := s.siteDepartures[args.SiteId]; found {
+		return sl_api.DeparturesResult{Departures: departures}, nil
 	}
 	if args.SiteId == siteIdExists {
-		return s.departures, nil
+		return sl_api.DeparturesResult{Departures: s.departures, StopDeviations: s.stopDeviations, Age: s.age, Stale: s.stale}, nil
 	}
-	return []sl_api.MappedSLDeparture{}, nil
+	return sl_api.DeparturesResult{Departures: []sl_api.MappedSLDeparture{}}, nil
+}
+
+func (s *slApiClientStub) Health() sl_api.Health {
+	return s.health
+}
+
+func (s *slApiClientStub) Caches() map[string]cache.Admin {
+	return s.caches
 }
 
-func (s *slApiClientStub) GetSites(searchTerm string) ([]sl_api.MappedSLSite, error) {
+func (s *slApiClientStub) GetSites(ctx context.Context, searchTerm string) ([]sl_api.MappedSLSite, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
 	return s.sites, nil
 }
 
+func (s *slApiClientStub) GetSite(ctx context.Context, id int) (sl_api.MappedSLSite, error) {
+	if s.err != nil {
+		return sl_api.MappedSLSite{}, s.err
+	}
+	for _, site := range s.sites {
+		if site.Id == id {
+			return site, nil
+		}
+	}
+	return sl_api.MappedSLSite{}, sl_api.ErrSiteNotFound
+}
+
+func (s *slApiClientStub) GetNearbySites(ctx context.Context, args sl_api.GetNearbySitesArgs) ([]sl_api.NearbySite, error) {
+	s.mu.Lock()
+	s.lastNearbyArgs = args
+	s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.nearby, nil
+}
+
 func TestRouter(t *testing.T) {
 
 	t.Run("departures route with existing site", func(t *testing.T) {
@@ -54,6 +119,125 @@ func TestRouter(t *testing.T) {
 		assert.JSONEq(t, got, string(want))
 	})
 
+	t.Run("departures include stop deviations when asked for", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		slApiMock.stopDeviations = []sl_api.MappedSLStopDeviation{
+			{Id: 1, ImportanceLevel: 7, Message: "Ersättningsbussar", Lines: []string{"43"}},
+		}
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/departures/%d?include=deviations", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+		require.Equal(t, http.StatusOK, response.Code)
+
+		var got v1.DeparturesResponse
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&got))
+		assert.Equal(t, v1.MapDepartures(slApiMock.departures), got.Departures)
+		assert.Equal(t, v1.MapStopDeviations(slApiMock.stopDeviations), got.StopDeviations)
+	})
+
+	t.Run("departures with unknown include returns bad request", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/departures/%d?include=deviations,weather", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+
+	t.Run("v1 departures route", func(t *testing.T) {
+		slApiMock, departuresJson := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/v1/sites/%d/departures", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, departuresJson, response.Body.String())
+		assert.Empty(t, response.Header().Get("deprecation"))
+	})
+
+	t.Run("old routes are deprecated aliases for v1", func(t *testing.T) {
+		slApiMock, departuresJson := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/departures/%d", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, departuresJson, response.Body.String())
+		assert.Equal(t, "true", response.Header().Get("deprecation"))
+		assert.Equal(t, fmt.Sprintf(`</api/v1/sites/%d/departures>; rel="successor-version"`, siteIdExists), response.Header().Get("link"))
+	})
+
+	t.Run("nearby sites is only in v1", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/sites/nearby?lat=59.3&lon=18.0"))
+
+		assertProblem(t, response, http.StatusNotFound, "not_found")
+		assert.Contains(t, response.Body.String(), "/api/v1/sites/nearby")
+	})
+
+	t.Run("nearby departures is only in v1", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/departures/nearby?lat=59.3&lon=18.0"))
+
+		assertProblem(t, response, http.StatusNotFound, "not_found")
+		assert.Contains(t, response.Body.String(), "/api/v1/departures/nearby")
+	})
+
+	t.Run("unsupported methods return 405 with allowed methods", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("/api/v1/sites/%d/departures", siteIdExists), nil)
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+
+		assertProblem(t, response, http.StatusMethodNotAllowed, "method_not_allowed")
+		assert.Equal(t, "GET, HEAD", response.Header().Get("allow"))
+	})
+
+	t.Run("departures with extra path segments is not found", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		for _, path := range []string{"/api/v1/sites/9325/departures/foo", "/api/departures/9325/foo"} {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, newGetRequest(path))
+			assertProblem(t, response, http.StatusNotFound, "not_found", path)
+		}
+	})
+
+	t.Run("problems carry the request id", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest("/api/v1/sites/x/departures")
+		request.Header.Set("x-request-id", "from-the-proxy")
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+		problem := assertProblem(t, response, http.StatusBadRequest, "invalid_site_id")
+		assert.Equal(t, "from-the-proxy", problem.RequestId)
+		assert.Equal(t, "from-the-proxy", response.Header().Get("x-request-id"))
+	})
+
 	t.Run("departures with unkown siteId returns empty array", func(t *testing.T) {
 		slApiMock, _ := buildSLClientStub(false)
 		router, _ := gosltimetable.NewRouter(slApiMock)
@@ -78,7 +262,9 @@ func TestRouter(t *testing.T) {
 		response := httptest.NewRecorder()
 
 		router.ServeHTTP(response, request)
-		assert.Equal(t, http.StatusBadRequest, response.Code)
+		problem := assertProblem(t, response, http.StatusBadRequest, "invalid_site_id")
+		assert.Equal(t, "id", problem.Param)
+		assert.Equal(t, "/api/departures/not-a-site-id", problem.Instance)
 	})
 
 	t.Run("departures with unparseable line returns bad request", func(t *testing.T) {
@@ -89,7 +275,91 @@ func TestRouter(t *testing.T) {
 		response := httptest.NewRecorder()
 
 		router.ServeHTTP(response, request)
-		assert.Equal(t, http.StatusBadRequest, response.Code)
+		problem := assertProblem(t, response, http.StatusBadRequest, "invalid_line")
+		assert.Equal(t, "line", problem.Param)
+	})
+
+	t.Run("departures accept lettered lines and transport aliases", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/departures/%d?line=43X&transport=pendelt%%C3%%A5g", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, []string{"43X"}, slApiMock.lastArgs.Lines)
+		assert.Equal(t, []sl_api.TransportType{sl_api.TransportTrain}, slApiMock.lastArgs.Transports)
+	})
+
+	t.Run("departures accept repeated and comma separated filters", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/departures/%d?line=43,44&line=113&direction=2&transport=train,buss", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, []string{"43", "44", "113"}, slApiMock.lastArgs.Lines)
+		assert.Equal(t, []int{2}, slApiMock.lastArgs.Directions)
+		assert.Equal(t, []sl_api.TransportType{sl_api.TransportTrain, sl_api.TransportBus}, slApiMock.lastArgs.Transports)
+	})
+
+	t.Run("departures pass the time window on", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/departures/%d?minMinutes=4&maxMinutes=30&limit=2", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, 4, slApiMock.lastArgs.MinMinutes)
+		assert.Equal(t, 30, slApiMock.lastArgs.MaxMinutes)
+		assert.Equal(t, 2, slApiMock.lastArgs.Limit)
+	})
+
+	t.Run("departures with a bad time window returns bad request", func(t *testing.T) {
+		cases := map[string]string{
+			"minMinutes=soon":            "invalid_min_minutes",
+			"maxMinutes=-1":              "invalid_max_minutes",
+			"limit=x":                    "invalid_limit",
+			"minMinutes=10&maxMinutes=5": "invalid_max_minutes",
+		}
+
+		for query, code := range cases {
+			slApiMock, _ := buildSLClientStub(false)
+			router, _ := gosltimetable.NewRouter(slApiMock)
+
+			request := newGetRequest(fmt.Sprintf("/api/departures/%d?%s", siteIdExists, query))
+			response := httptest.NewRecorder()
+
+			router.ServeHTTP(response, request)
+			assertProblem(t, response, http.StatusBadRequest, code, query)
+		}
+	})
+
+	t.Run("departures with direction other than 1 or 2 returns bad request", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/departures/%d?direction=1,3", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+		assertProblem(t, response, http.StatusBadRequest, "invalid_direction")
+	})
+
+	t.Run("departures with unknown transport returns bad request", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		request := newGetRequest(fmt.Sprintf("/api/departures/%d?transport=rocket", siteIdExists))
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request)
+		assertProblem(t, response, http.StatusBadRequest, "invalid_transport")
 	})
 
 	t.Run("returns 500 on sl api error", func(t *testing.T) {
@@ -101,7 +371,166 @@ func TestRouter(t *testing.T) {
 
 		router.ServeHTTP(response, request)
 
-		assert.Equal(t, http.StatusInternalServerError, response.Code)
+		problem := assertProblem(t, response, http.StatusInternalServerError, "internal_error")
+		assert.Equal(t, "Internal Server Error", problem.Detail)
+	})
+
+	t.Run("maps upstream errors to status codes", func(t *testing.T) {
+		cases := []struct {
+			err  error
+			want int
+			code string
+		}{
+			{fmt.Errorf("wrapped, %w", sl_api.ErrSiteNotFound), http.StatusNotFound, "site_not_found"},
+			{&sl_api.UpstreamError{Err: sl_api.ErrRateLimited, StatusCode: 429}, http.StatusTooManyRequests, "rate_limited"},
+			{fmt.Errorf("wrapped, %w", sl_api.ErrUpstreamMalformed), http.StatusBadGateway, "upstream_malformed"},
+			{fmt.Errorf("wrapped, %w", sl_api.ErrUpstreamUnavailable), http.StatusServiceUnavailable, "upstream_unavailable"},
+			{fmt.Errorf("wrapped, %w", sl_api.ErrInvalidTransportType), http.StatusBadRequest, "invalid_transport"},
+		}
+
+		for _, c := range cases {
+			slApiMock, _ := buildSLClientStub(false)
+			slApiMock.err = c.err
+			router, _ := gosltimetable.NewRouter(slApiMock)
+
+			request := newGetRequest(fmt.Sprintf("/api/departures/%d", siteIdExists))
+			response := httptest.NewRecorder()
+
+			router.ServeHTTP(response, request)
+
+			assertProblem(t, response, c.want, c.code, c.err.Error())
+		}
+	})
+
+	t.Run("serves last known departures as stale while circuit is open", func(t *testing.T) {
+		slApiMock, departuresJson := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+		path := fmt.Sprintf("/api/departures/%d", siteIdExists)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest(path))
+		require.Equal(t, http.StatusOK, response.Code)
+		assert.Empty(t, response.Header().Get("x-stale"))
+
+		slApiMock.err = fmt.Errorf("wrapped, %w", sl_api.ErrCircuitOpen)
+
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest(path))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "true", response.Header().Get("x-stale"))
+		assert.JSONEq(t, departuresJson, response.Body.String())
+	})
+
+	t.Run("last known departures are counted down again", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		slApiMock.departures = []sl_api.MappedSLDeparture{departureAt("a", 2), departureAt("b", 5), departureAt("c", 14)}
+		clock := cachetest.NewFakeClock(time.Date(2025, 1, 15, 8, 0, 0, 0, time.UTC))
+		router, _ := gosltimetable.NewRouter(slApiMock, gosltimetable.WithClock(clock))
+		path := fmt.Sprintf("/api/v1/sites/%d/departures?maxMinutes=10", siteIdExists)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest(path))
+		require.Equal(t, http.StatusOK, response.Code)
+
+		slApiMock.err = sl_api.ErrCircuitOpen
+		clock.Advance(3 * time.Minute)
+
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest(path))
+		require.Equal(t, http.StatusOK, response.Code)
+
+		var departures []v1.Departure
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &departures))
+		// a left a minute ago, c is still more than 10 minutes away
+		require.Len(t, departures, 1)
+		assert.Equal(t, "b", departures[0].Destination)
+		assert.Equal(t, 120, *departures[0].SecondsUntilDeparture)
+		assert.Equal(t, "180", response.Header().Get("age"))
+	})
+
+	t.Run("departures say how old they are", func(t *testing.T) {
+		slApiMock, departuresJson := buildSLClientStub(false)
+		slApiMock.age = 7 * time.Second
+		slApiMock.stale = true
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest(fmt.Sprintf("/api/departures/%d", siteIdExists)))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "7", response.Header().Get("age"))
+		assert.Equal(t, "true", response.Header().Get("x-stale"))
+		assert.JSONEq(t, departuresJson, response.Body.String())
+	})
+
+	t.Run("open circuit without previous departures returns 503", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		slApiMock.err = sl_api.ErrCircuitOpen
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest(fmt.Sprintf("/api/departures/%d", siteIdExists)))
+
+		assertProblem(t, response, http.StatusServiceUnavailable, "upstream_unavailable")
+	})
+
+	t.Run("health endpoint reports circuit state", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/health"))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"Status": "ok", "Upstream": {"Circuit": "closed"}}`, response.Body.String())
+
+		slApiMock.health = sl_api.Health{Circuit: sl_api.BreakerOpen}
+
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/health"))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"Status": "degraded", "Upstream": {"Circuit": "open"}}`, response.Body.String())
+	})
+
+	t.Run("metrics endpoint exposes cache metrics", func(t *testing.T) {
+		departures := cache.NewCache[string, int]()
+		departures.Set("sites-1", 1, time.Minute)
+		departures.Get("sites-1")
+		departures.Get("sites-2")
+
+		slApiMock, _ := buildSLClientStub(false)
+		slApiMock.caches = map[string]cache.Admin{"departures": departures}
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/metrics"))
+
+		require.Equal(t, http.StatusOK, response.Code)
+		parsed, err := metricstest.Parse(response.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, "counter", parsed.Types["cache_hits_total"])
+		assert.Equal(t, "gauge", parsed.Types["cache_entries"])
+		assert.Equal(t, 1.0, parsed.Values[`cache_hits_total{cache="departures"}`])
+		assert.Equal(t, 1.0, parsed.Values[`cache_misses_total{cache="departures"}`])
+		assert.Equal(t, 1.0, parsed.Values[`cache_sets_total{cache="departures"}`])
+		assert.Equal(t, 1.0, parsed.Values[`cache_entries{cache="departures"}`])
+		assert.Contains(t, parsed.Values, `cache_entries{cache="stale-departures"}`)
+	})
+
+	t.Run("metrics endpoint works when the sl client has no caches", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/metrics"))
+
+		require.Equal(t, http.StatusOK, response.Code)
+		parsed, err := metricstest.Parse(response.Body)
+		require.NoError(t, err)
+		assert.Contains(t, parsed.Values, `cache_entries{cache="stale-departures"}`)
 	})
 
 	t.Run("sites endpoint search", func(t *testing.T) {
@@ -117,6 +546,127 @@ func TestRouter(t *testing.T) {
 		assert.Equal(t, "application/json", response.Header().Get("content-type"))
 	})
 
+	t.Run("sites endpoint pages with limit and offset", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		for id := 10; id < 20; id++ {
+			slApiMock.sites = append(slApiMock.sites, sl_api.MappedSLSite{Id: id, Name: fmt.Sprintf("Site %d", id)})
+		}
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		ids := func(path string) []int {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, newGetRequest(path))
+			require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+
+			var sites []v1.Site
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&sites))
+			got := []int{}
+			for _, site := range sites {
+				got = append(got, site.Id)
+			}
+			return got
+		}
+
+		assert.Len(t, ids("/api/v1/sites?term=site"), 5)
+		assert.Equal(t, []int{1, 2, 10}, ids("/api/v1/sites?term=site&limit=3"))
+		assert.Equal(t, []int{12, 13}, ids("/api/v1/sites?term=site&limit=2&offset=4"))
+		assert.Equal(t, []int{}, ids("/api/v1/sites?term=site&offset=100"))
+
+		for path, code := range map[string]string{
+			"/api/v1/sites?term=site&limit=0x":  "invalid_limit",
+			"/api/v1/sites?term=site&limit=51":  "invalid_limit",
+			"/api/v1/sites?term=site&offset=-1": "invalid_offset",
+			"/api/v1/sites?term=site&limit=-1":  "invalid_limit",
+		} {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, newGetRequest(path))
+			assertProblem(t, response, http.StatusBadRequest, code, path)
+		}
+	})
+
+	t.Run("sites endpoint reports sl errors", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		slApiMock.err = fmt.Errorf("wrapped, %w", sl_api.ErrUpstreamUnavailable)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/sites?term=sundby"))
+
+		assertProblem(t, response, http.StatusServiceUnavailable, "upstream_unavailable")
+	})
+
+	t.Run("site by id is only in v1", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/sites/2"))
+
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"Id": 2, "Name": "Solna", "Alias": ["Blåkulla"], "Lat": 59.36, "Lon": 18.0}`, response.Body.String())
+
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/sites/2"))
+
+		assertProblem(t, response, http.StatusNotFound, "not_found")
+		assert.Contains(t, response.Body.String(), "/api/v1/sites/2")
+	})
+
+	t.Run("unknown site id returns 404", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/sites/404"))
+		assertProblem(t, response, http.StatusNotFound, "site_not_found")
+
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/sites/solna"))
+		assertProblem(t, response, http.StatusBadRequest, "invalid_site_id")
+	})
+
+	t.Run("nearby sites", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		slApiMock.nearby = []sl_api.NearbySite{
+			{Site: sl_api.MappedSLSite{Id: 9001, Name: "T-Centralen", Alias: []string{}, Lat: 59.3313, Lon: 18.0597}, Distance: 12.4},
+		}
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/sites/nearby?lat=59.3313&lon=18.0597"))
+
+		require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+		assert.JSONEq(t, `[{"Id": 9001, "Name": "T-Centralen", "Alias": [], "Lat": 59.3313, "Lon": 18.0597, "Distance": 12}]`, response.Body.String())
+		assert.Equal(t, sl_api.GetNearbySitesArgs{Lat: 59.3313, Lon: 18.0597, Radius: 500, Limit: 10}, slApiMock.lastNearbyArgs)
+
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, newGetRequest("/api/v1/sites/nearby?lat=59.3313&lon=18.0597&radius=1200&limit=3"))
+
+		require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+		assert.Equal(t, sl_api.GetNearbySitesArgs{Lat: 59.3313, Lon: 18.0597, Radius: 1200, Limit: 3}, slApiMock.lastNearbyArgs)
+	})
+
+	t.Run("nearby sites with bad coordinates return bad request", func(t *testing.T) {
+		slApiMock, _ := buildSLClientStub(false)
+		router, _ := gosltimetable.NewRouter(slApiMock)
+
+		cases := map[string]string{
+			"/api/v1/sites/nearby?lon=18.05":                       "invalid_lat",
+			"/api/v1/sites/nearby?lat=59.33":                       "invalid_lon",
+			"/api/v1/sites/nearby?lat=north&lon=18.05":             "invalid_lat",
+			"/api/v1/sites/nearby?lat=91&lon=18.05":                "invalid_lat",
+			"/api/v1/sites/nearby?lat=59.33&lon=NaN":               "invalid_lon",
+			"/api/v1/sites/nearby?lat=59.33&lon=18.05&radius=5001": "invalid_radius",
+			"/api/v1/sites/nearby?lat=59.33&lon=18.05&radius=-1":   "invalid_radius",
+			"/api/v1/sites/nearby?lat=59.33&lon=18.05&limit=100":   "invalid_limit",
+		}
+
+		for path, code := range cases {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, newGetRequest(path))
+			assertProblem(t, response, http.StatusBadRequest, code, path)
+		}
+	})
 }
 
 func buildSLClientStub(shouldError bool) (*slApiClientStub, string) {
@@ -128,6 +678,9 @@ func buildSLClientStub(shouldError bool) (*slApiClientStub, string) {
 			TransportMode: "BUS",
 			GroupOfLines:  "",
 			State:         "EXPECTED",
+			Deviations: []sl_api.MappedSLDeviation{
+				{ImportanceLevel: 5, Consequence: "CANCELLED", Message: "Inställd"},
+			},
 		},
 		{
 			Destination:   "Mock Destination",
@@ -141,19 +694,54 @@ func buildSLClientStub(shouldError bool) (*slApiClientStub, string) {
 
 	mockSites := []sl_api.MappedSLSite{
 		{Id: 1, Name: "Sundbyberg", Alias: []string{"Sundbybergs centrum"}},
-		{Id: 2, Name: "Solna", Alias: []string{"Blåkulla"}},
+		{Id: 2, Name: "Solna", Alias: []string{"Blåkulla"}, Lat: 59.36, Lon: 18.0},
 	}
-	stub := &slApiClientStub{mockDepartures, mockSites, nil}
+	stub := &slApiClientStub{departures: mockDepartures, sites: mockSites}
 	if shouldError {
 		stub.err = fmt.Errorf("error")
 	}
-	mockDeparturesJson, _ := json.Marshal(mockDepartures)
+	mockDeparturesJson, _ := json.Marshal(v1.MapDepartures(mockDepartures))
 
 	return stub, string(mockDeparturesJson)
 
 }
 
+// assertProblem checks that the response is a problem with status and
+// code, and returns it for further checks
+func assertProblem(t *testing.T, response *httptest.ResponseRecorder, status int, code string, msgAndArgs ...any) gosltimetable.Problem {
+	t.Helper()
+
+	var problem gosltimetable.Problem
+	assert.Equal(t, status, response.Code, msgAndArgs...)
+	assert.Equal(t, "application/problem+json", response.Header().Get("content-type"), msgAndArgs...)
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &problem), msgAndArgs...)
+	assert.Equal(t, code, problem.Code, msgAndArgs...)
+	assert.Equal(t, status, problem.Status, msgAndArgs...)
+	assert.NotEmpty(t, problem.RequestId, msgAndArgs...)
+	return problem
+}
+
 func newGetRequest(path string) *http.Request {
 	req, _ := http.NewRequest(http.MethodGet, path, nil)
 	return req
 }
+
+// decodeJSON checks the response is a 200 and decodes its body
+func decodeJSON[T any](t *testing.T, response *httptest.ResponseRecorder) T {
+	t.Helper()
+	require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+	var decoded T
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&decoded))
+	return decoded
+}
+
+// buildSitesStub answers with departures for each site in departures,
+// site 3 is always unavailable
+func buildSitesStub(departures map[int][]sl_api.MappedSLDeparture) *slApiClientStub {
+	stub, _ := buildSLClientStub(false)
+	stub.siteDepartures = departures
+	stub.siteErrs = map[int]error{
+		3: fmt.Errorf("wrapped, %w", sl_api.ErrUpstreamUnavailable),
+	}
+	return stub
+}
@@ -0,0 +1,246 @@
+// Package sitestore keeps the sites from sl in sqlite, so the server can
+// start and search sites without asking sl
+package sitestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+create table if not exists sites (
+	id integer primary key,
+	gid integer not null,
+	name text not null,
+	note text not null,
+	abbreviation text not null,
+	lat real not null,
+	lon real not null,
+	valid_from text not null,
+	-- json arrays
+	alias text not null,
+	stop_areas text not null
+);
+
+-- what every save changed, to see when sl added or moved a site
+create table if not exists site_changes (
+	saved_at text not null,
+	site_id integer not null,
+	change text not null
+);
+
+create table if not exists saves (
+	saved_at text not null
+);
+`
+
+type Store struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+var _ sl_api.SiteStore = (*Store)(nil)
+
+// Open opens or creates the database at path
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)", path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening site store %s, %w", path, err)
+	}
+	// sqlite has one writer anyway, and this keeps saves from getting
+	// busy errors from each other
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating site store tables in %s, %w", path, err)
+	}
+
+	return &Store{db: db, now: time.Now}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Sites(ctx context.Context) ([]sl_api.SLApiSite, error) {
+	return querySites(ctx, s.db)
+}
+
+// Save replaces the stored sites in one transaction and records what
+// changed in site_changes
+func (s *Store) Save(ctx context.Context, sites []sl_api.SLApiSite) (sl_api.SiteChanges, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sl_api.SiteChanges{}, fmt.Errorf("error starting save of sites, %w", err)
+	}
+	defer tx.Rollback()
+
+	stored, err := querySites(ctx, tx)
+	if err != nil {
+		return sl_api.SiteChanges{}, err
+	}
+
+	changes := diff(stored, sites)
+	savedAt := s.now().UTC().Format(time.RFC3339)
+
+	for _, id := range changes.Removed {
+		if _, err := tx.ExecContext(ctx, "delete from sites where id = ?", id); err != nil {
+			return sl_api.SiteChanges{}, fmt.Errorf("error removing site %d, %w", id, err)
+		}
+	}
+
+	byId := make(map[int]sl_api.SLApiSite, len(sites))
+	for _, site := range sites {
+		byId[site.ID] = site
+	}
+	for _, id := range slices.Concat(changes.Added, changes.Changed) {
+		if err := upsertSite(ctx, tx, byId[id]); err != nil {
+			return sl_api.SiteChanges{}, err
+		}
+	}
+
+	for change, ids := range map[string][]int{"added": changes.Added, "removed": changes.Removed, "changed": changes.Changed} {
+		for _, id := range ids {
+			if _, err := tx.ExecContext(ctx, "insert into site_changes (saved_at, site_id, change) values (?, ?, ?)", savedAt, id, change); err != nil {
+				return sl_api.SiteChanges{}, fmt.Errorf("error recording change of site %d, %w", id, err)
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "insert into saves (saved_at) values (?)", savedAt); err != nil {
+		return sl_api.SiteChanges{}, fmt.Errorf("error recording save of sites, %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return sl_api.SiteChanges{}, fmt.Errorf("error saving sites, %w", err)
+	}
+	return changes, nil
+}
+
+func (s *Store) SavedAt(ctx context.Context) (time.Time, error) {
+	var savedAt sql.NullString
+	if err := s.db.QueryRowContext(ctx, "select max(saved_at) from saves").Scan(&savedAt); err != nil {
+		return time.Time{}, fmt.Errorf("error reading when sites were saved, %w", err)
+	}
+	if !savedAt.Valid {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, savedAt.String)
+}
+
+// the parts of sql.DB and sql.Tx we use
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func querySites(ctx context.Context, db queryer) ([]sl_api.SLApiSite, error) {
+	rows, err := db.QueryContext(ctx, `
+		select id, gid, name, note, abbreviation, lat, lon, valid_from, alias, stop_areas
+		from sites order by id`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sites, %w", err)
+	}
+	defer rows.Close()
+
+	sites := []sl_api.SLApiSite{}
+	for rows.Next() {
+		var site sl_api.SLApiSite
+		var alias, stopAreas string
+		err := rows.Scan(&site.ID, &site.Gid, &site.Name, &site.Note, &site.Abbreviation, &site.Lat, &site.Lon, &site.Valid.From, &alias, &stopAreas)
+		if err != nil {
+			return nil, fmt.Errorf("error reading site, %w", err)
+		}
+		if err := json.Unmarshal([]byte(alias), &site.Alias); err != nil {
+			return nil, fmt.Errorf("error reading alias of site %d, %w", site.ID, err)
+		}
+		if err := json.Unmarshal([]byte(stopAreas), &site.StopAreas); err != nil {
+			return nil, fmt.Errorf("error reading stop areas of site %d, %w", site.ID, err)
+		}
+		sites = append(sites, site)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading sites, %w", err)
+	}
+	return sites, nil
+}
+
+func upsertSite(ctx context.Context, tx *sql.Tx, site sl_api.SLApiSite) error {
+	alias, _ := json.Marshal(nonNil(site.Alias))
+	stopAreas, _ := json.Marshal(nonNil(site.StopAreas))
+
+	_, err := tx.ExecContext(ctx, `
+		insert into sites (id, gid, name, note, abbreviation, lat, lon, valid_from, alias, stop_areas)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		on conflict (id) do update set
+			gid = excluded.gid, name = excluded.name, note = excluded.note,
+			abbreviation = excluded.abbreviation, lat = excluded.lat, lon = excluded.lon,
+			valid_from = excluded.valid_from, alias = excluded.alias, stop_areas = excluded.stop_areas`,
+		site.ID, site.Gid, site.Name, site.Note, site.Abbreviation, site.Lat, site.Lon, site.Valid.From, string(alias), string(stopAreas),
+	)
+	if err != nil {
+		return fmt.Errorf("error storing site %d, %w", site.ID, err)
+	}
+	return nil
+}
+
+// diff is what changed going from the stored sites to the new ones, by id
+func diff(stored []sl_api.SLApiSite, sites []sl_api.SLApiSite) sl_api.SiteChanges {
+	old := make(map[int]sl_api.SLApiSite, len(stored))
+	for _, site := range stored {
+		old[site.ID] = site
+	}
+
+	var changes sl_api.SiteChanges
+	seen := make(map[int]bool, len(sites))
+	for _, site := range sites {
+		seen[site.ID] = true
+		before, found := old[site.ID]
+		switch {
+		case !found:
+			changes.Added = append(changes.Added, site.ID)
+		case !sameSite(before, site):
+			changes.Changed = append(changes.Changed, site.ID)
+		}
+	}
+	for _, site := range stored {
+		if !seen[site.ID] {
+			changes.Removed = append(changes.Removed, site.ID)
+		}
+	}
+
+	slices.Sort(changes.Added)
+	slices.Sort(changes.Changed)
+	slices.Sort(changes.Removed)
+	return changes
+}
+
+// sameSite compares every stored field, a nil and an empty list are the
+// same
+func sameSite(a sl_api.SLApiSite, b sl_api.SLApiSite) bool {
+	return a.ID == b.ID &&
+		a.Gid == b.Gid &&
+		a.Name == b.Name &&
+		a.Note == b.Note &&
+		a.Abbreviation == b.Abbreviation &&
+		a.Lat == b.Lat &&
+		a.Lon == b.Lon &&
+		a.Valid.From == b.Valid.From &&
+		slices.Equal(a.Alias, b.Alias) &&
+		slices.Equal(a.StopAreas, b.StopAreas)
+}
+
+func nonNil[T any](values []T) []T {
+	if values == nil {
+		return []T{}
+	}
+	return values
+}
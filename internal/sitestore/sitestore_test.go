@@ -0,0 +1,106 @@
+package sitestore_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sitestore"
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func site(id int, name string) sl_api.SLApiSite {
+	s := sl_api.SLApiSite{
+		ID:           id,
+		Gid:          9091001000000000 + int64(id),
+		Name:         name,
+		Abbreviation: "ABC",
+		Lat:          59.33,
+		Lon:          18.06,
+		StopAreas:    []int{id * 10, id*10 + 1},
+		Alias:        []string{name + " station"},
+	}
+	s.Valid.From = "2017-10-11T00:00:00"
+	return s
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+
+	open := func(t *testing.T, path string) *sitestore.Store {
+		t.Helper()
+		store, err := sitestore.Open(path)
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return store
+	}
+
+	t.Run("empty before the first save", func(t *testing.T) {
+		store := open(t, filepath.Join(t.TempDir(), "sites.db"))
+
+		sites, err := store.Sites(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, sites)
+
+		savedAt, err := store.SavedAt(ctx)
+		require.NoError(t, err)
+		assert.True(t, savedAt.IsZero())
+	})
+
+	t.Run("keeps every field between opens", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sites.db")
+		sundbyberg := site(9325, "Sundbyberg")
+		noAlias := site(9326, "Solna strand")
+		noAlias.Alias = nil
+		noAlias.Note = "Byggs om"
+
+		before := time.Now().Add(-time.Second)
+		store := open(t, path)
+		_, err := store.Save(ctx, []sl_api.SLApiSite{noAlias, sundbyberg})
+		require.NoError(t, err)
+		store.Close()
+
+		store = open(t, path)
+		sites, err := store.Sites(ctx)
+		require.NoError(t, err)
+
+		noAlias.Alias = []string{}
+		assert.Equal(t, []sl_api.SLApiSite{sundbyberg, noAlias}, sites)
+
+		savedAt, err := store.SavedAt(ctx)
+		require.NoError(t, err)
+		assert.True(t, savedAt.After(before), savedAt)
+	})
+
+	t.Run("save replaces the sites and says what changed", func(t *testing.T) {
+		store := open(t, filepath.Join(t.TempDir(), "sites.db"))
+
+		changes, err := store.Save(ctx, []sl_api.SLApiSite{site(1, "Odenplan"), site(2, "Slussen"), site(3, "Ropsten")})
+		require.NoError(t, err)
+		assert.Equal(t, sl_api.SiteChanges{Added: []int{1, 2, 3}}, changes)
+
+		moved := site(2, "Slussen")
+		moved.Lat = 59.32
+		renamed := site(3, "Ropsten")
+		renamed.StopAreas = []int{99}
+		changes, err = store.Save(ctx, []sl_api.SLApiSite{moved, renamed, site(4, "Gullmarsplan")})
+		require.NoError(t, err)
+		assert.Equal(t, sl_api.SiteChanges{Added: []int{4}, Removed: []int{1}, Changed: []int{2, 3}}, changes)
+
+		sites, err := store.Sites(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []sl_api.SLApiSite{moved, renamed, site(4, "Gullmarsplan")}, sites)
+
+		changes, err = store.Save(ctx, sites)
+		require.NoError(t, err)
+		assert.Equal(t, sl_api.SiteChanges{}, changes)
+	})
+
+	t.Run("a path that can't be opened is an error", func(t *testing.T) {
+		_, err := sitestore.Open(filepath.Join(t.TempDir(), "missing", "sites.db"))
+		assert.Error(t, err)
+	})
+}
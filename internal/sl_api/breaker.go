@@ -0,0 +1,188 @@
+package sl_api
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache"
+)
+
+// wraps ErrUpstreamUnavailable so callers that don't care about the
+// breaker treat it like sl being down
+var ErrCircuitOpen = fmt.Errorf("circuit open, %w", ErrUpstreamUnavailable)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+type BreakerConfig struct {
+	// outcomes older than this don't count towards the failure rate
+	Window time.Duration
+	// don't trip on the first failed request after a quiet period
+	MinRequests int
+	// failure rate (0-1) within the window that opens the circuit
+	FailureThreshold float64
+	// how long the circuit stays open before letting a probe through
+	CoolDown time.Duration
+}
+
+var DefaultBreakerConfig = BreakerConfig{
+	Window:           30 * time.Second,
+	MinRequests:      10,
+	FailureThreshold: 0.5,
+	CoolDown:         15 * time.Second,
+}
+
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+// CircuitBreaker stops us from hammering sl (and making our users wait
+// for the full timeout) when it's down. Closed lets everything through,
+// open fails fast until the cool down has passed, half-open lets a
+// single probe through that decides if we close or open again
+type CircuitBreaker struct {
+	config   BreakerConfig
+	clock    cache.Clock
+	mu       sync.Mutex
+	state    BreakerState
+	openedAt time.Time
+	probing  bool
+	outcomes []outcome
+}
+
+func NewCircuitBreaker(config BreakerConfig, clock cache.Clock) *CircuitBreaker {
+	return &CircuitBreaker{config: config, clock: clock}
+}
+
+// Allow returns ErrCircuitOpen when the call shouldn't be made. Every
+// allowed call must be followed by Record
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+	}
+
+	return nil
+}
+
+// Record the outcome of an allowed call
+func (b *CircuitBreaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.open(now)
+		} else {
+			b.state = BreakerClosed
+			b.outcomes = nil
+		}
+		return
+	}
+
+	b.outcomes = append(b.outcomes, outcome{now, failed})
+	b.prune(now)
+
+	if b.state == BreakerClosed && b.shouldTrip() {
+		b.open(now)
+	}
+}
+
+// Skip releases an allowed call without recording an outcome, used when
+// the caller went away before sl answered
+func (b *CircuitBreaker) Skip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.currentState()
+}
+
+// currentState moves an open breaker to half-open once the cool down
+// has passed, must be called with the lock held
+func (b *CircuitBreaker) currentState() BreakerState {
+	if b.state == BreakerOpen && !b.clock.Now().Before(b.openedAt.Add(b.config.CoolDown)) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.outcomes = nil
+}
+
+func (b *CircuitBreaker) prune(now time.Time) {
+	cutoff := now.Add(-b.config.Window)
+
+	i := 0
+	for i < len(b.outcomes) && b.outcomes[i].at.Before(cutoff) {
+		i++
+	}
+	b.outcomes = b.outcomes[i:]
+}
+
+func (b *CircuitBreaker) shouldTrip() bool {
+	if len(b.outcomes) < b.config.MinRequests {
+		return false
+	}
+
+	failures := 0
+	for _, o := range b.outcomes {
+		if o.failed {
+			failures++
+		}
+	}
+
+	return float64(failures)/float64(len(b.outcomes)) >= b.config.FailureThreshold
+}
+
+// countsAsFailure only counts errors where sl is down or overloaded,
+// a 404 or the caller going away says nothing about sl's health
+func countsAsFailure(err error) bool {
+	return err != nil && isRetryable(err) && !errors.Is(err, ErrCircuitOpen)
+}
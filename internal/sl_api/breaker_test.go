@@ -0,0 +1,134 @@
+package sl_api_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache/cachetest"
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testBreakerConfig = sl_api.BreakerConfig{
+	Window:           10 * time.Second,
+	MinRequests:      4,
+	FailureThreshold: 0.5,
+	CoolDown:         5 * time.Second,
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("opens when failure rate is reached", func(t *testing.T) {
+		breaker := sl_api.NewCircuitBreaker(testBreakerConfig, cachetest.NewFakeClock(time.Now()))
+
+		for _, failed := range []bool{false, true, false} {
+			require.NoError(t, breaker.Allow())
+			breaker.Record(failed)
+		}
+		assert.Equal(t, sl_api.BreakerClosed, breaker.State())
+
+		require.NoError(t, breaker.Allow())
+		breaker.Record(true)
+
+		assert.Equal(t, sl_api.BreakerOpen, breaker.State())
+		assert.ErrorIs(t, breaker.Allow(), sl_api.ErrCircuitOpen)
+		assert.ErrorIs(t, breaker.Allow(), sl_api.ErrUpstreamUnavailable)
+	})
+
+	t.Run("old failures fall out of the window", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		breaker := sl_api.NewCircuitBreaker(testBreakerConfig, clock)
+
+		for range 3 {
+			breaker.Allow()
+			breaker.Record(true)
+		}
+
+		clock.Advance(11 * time.Second)
+
+		breaker.Allow()
+		breaker.Record(true)
+
+		assert.Equal(t, sl_api.BreakerClosed, breaker.State())
+	})
+
+	t.Run("half-open lets a single probe through", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		breaker := sl_api.NewCircuitBreaker(testBreakerConfig, clock)
+
+		for range 4 {
+			breaker.Allow()
+			breaker.Record(true)
+		}
+		require.Equal(t, sl_api.BreakerOpen, breaker.State())
+
+		clock.Advance(5 * time.Second)
+		assert.Equal(t, sl_api.BreakerHalfOpen, breaker.State())
+
+		require.NoError(t, breaker.Allow())
+		assert.ErrorIs(t, breaker.Allow(), sl_api.ErrCircuitOpen)
+
+		breaker.Record(false)
+		assert.Equal(t, sl_api.BreakerClosed, breaker.State())
+		assert.NoError(t, breaker.Allow())
+	})
+
+	t.Run("failed probe opens the circuit again", func(t *testing.T) {
+		clock := cachetest.NewFakeClock(time.Now())
+		breaker := sl_api.NewCircuitBreaker(testBreakerConfig, clock)
+
+		for range 4 {
+			breaker.Allow()
+			breaker.Record(true)
+		}
+
+		clock.Advance(5 * time.Second)
+		require.NoError(t, breaker.Allow())
+		breaker.Record(true)
+
+		assert.Equal(t, sl_api.BreakerOpen, breaker.State())
+
+		clock.Advance(4 * time.Second)
+		assert.Equal(t, sl_api.BreakerOpen, breaker.State())
+	})
+
+	t.Run("sl api fails fast while the circuit is open", func(t *testing.T) {
+		server, calls := newFailingServer(100, http.StatusServiceUnavailable, mockSLDeparturesResponse)
+		defer server.Close()
+
+		breaker := sl_api.NewCircuitBreaker(testBreakerConfig, cachetest.NewFakeClock(time.Now()))
+		slApi := sl_api.NewSLApi(
+			server.Client(),
+			server.URL,
+			sl_api.WithRetryPolicy(sl_api.NoRetryPolicy),
+			sl_api.WithCircuitBreaker(breaker),
+		)
+
+		for range 4 {
+			_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+			require.ErrorIs(t, err, sl_api.ErrUpstreamUnavailable)
+		}
+
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		assert.ErrorIs(t, err, sl_api.ErrCircuitOpen)
+		assert.Equal(t, int32(4), calls.Load())
+		assert.Equal(t, sl_api.BreakerOpen, slApi.Health().Circuit)
+	})
+
+	t.Run("not found does not count as a failure", func(t *testing.T) {
+		server, _ := newFailingServer(100, http.StatusNotFound, mockSLDeparturesResponse)
+		defer server.Close()
+
+		breaker := sl_api.NewCircuitBreaker(testBreakerConfig, cachetest.NewFakeClock(time.Now()))
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithCircuitBreaker(breaker))
+
+		for range 10 {
+			slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		}
+
+		assert.Equal(t, sl_api.BreakerClosed, breaker.State())
+	})
+}
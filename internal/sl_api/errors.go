@@ -0,0 +1,65 @@
+package sl_api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrUpstreamUnavailable = errors.New("sl upstream unavailable")
+	ErrRateLimited         = errors.New("rate limited by sl")
+	ErrSiteNotFound        = errors.New("site not found")
+	ErrUpstreamMalformed   = errors.New("malformed response from sl")
+)
+
+// how much of the response body we keep on the error, enough to
+// see what sl complained about without logging a whole sites payload
+const bodyExcerptLength = 256
+
+// UpstreamError is returned when sl answers with something we can't use.
+// Err is always one of the sentinel errors above so callers can use
+// errors.Is without caring about the status code
+type UpstreamError struct {
+	Err        error
+	StatusCode int
+	Body       string
+	// parsed from the Retry-After header, 0 if sl didn't send one
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %q", e.Err, e.Body)
+	}
+	return fmt.Sprintf("%s (status %d): %q", e.Err, e.StatusCode, e.Body)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+func newUpstreamError(err error, statusCode int, body []byte) *UpstreamError {
+	if len(body) > bodyExcerptLength {
+		body = body[:bodyExcerptLength]
+	}
+	return &UpstreamError{Err: err, StatusCode: statusCode, Body: string(body)}
+}
+
+// checkStatus maps non 2xx responses from sl to an UpstreamError, nil
+// means the status is ok and the body can be decoded
+func checkStatus(statusCode int, body []byte) error {
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		return nil
+	case statusCode == http.StatusNotFound:
+		return newUpstreamError(ErrSiteNotFound, statusCode, body)
+	case statusCode == http.StatusTooManyRequests:
+		return newUpstreamError(ErrRateLimited, statusCode, body)
+	case statusCode >= 500:
+		return newUpstreamError(ErrUpstreamUnavailable, statusCode, body)
+	default:
+		return newUpstreamError(ErrUpstreamMalformed, statusCode, body)
+	}
+}
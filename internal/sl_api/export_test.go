@@ -0,0 +1,34 @@
+package sl_api
+
+import "time"
+
+// for the tests and benchmarks in sl_api_test, the search without and
+// with the index
+
+// SearchSites ranks every site for every search, it's what the index
+// is checked against and measured by. An empty search term matches
+// every site, in the order sl sent them
+func SearchSites(sites []MappedSLSite, searchTerm string) []MappedSLSite {
+	term := newQuery(searchTerm)
+	if term.text == "" {
+		return sites
+	}
+
+	var matches []siteMatch
+	for _, site := range sites {
+		if match := matchSite(site, searchNames(site), term); match.rank != rankNone {
+			matches = append(matches, match)
+		}
+	}
+	return sortMatches(matches)
+}
+
+var NormalizeSearch = normalizeSearch
+
+func NewSiteSearch(sites []MappedSLSite) func(searchTerm string) []MappedSLSite {
+	return newSiteIndex(sites).search
+}
+
+func SetSitesRetryInterval(s *SLApi, interval time.Duration) {
+	s.sitesRetryInterval = interval
+}
@@ -0,0 +1,78 @@
+package sl_api
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/utils"
+)
+
+// filterDepartures keeps the departures matching the filters in args,
+// without touching the cached slice
+func filterDepartures(departures []MappedSLDeparture, args GetDeparturesArgs) []MappedSLDeparture {
+	if len(args.Lines) == 0 && len(args.Directions) == 0 && len(args.Transports) == 0 {
+		return departures
+	}
+
+	matchesLine := func(d MappedSLDeparture) bool {
+		return len(args.Lines) == 0 || slices.ContainsFunc(args.Lines, func(line string) bool {
+			return strings.EqualFold(d.LineDesignation, line)
+		})
+	}
+	matchesDirection := func(d MappedSLDeparture) bool {
+		return len(args.Directions) == 0 || slices.Contains(args.Directions, d.DirectionCode)
+	}
+	matchesTransport := func(d MappedSLDeparture) bool {
+		return len(args.Transports) == 0 || slices.Contains(args.Transports, TransportType(d.TransportMode))
+	}
+
+	return utils.Filter(departures, func(d MappedSLDeparture) bool {
+		return matchesLine(d) && matchesDirection(d) && matchesTransport(d)
+	})
+}
+
+// limitDepartures applies the time window and the per group limit to
+// departures that have been counted down, sorted by when they leave.
+// Sorts in place, departures must be copies from withCountdown
+func limitDepartures(departures []MappedSLDeparture, args GetDeparturesArgs) []MappedSLDeparture {
+	slices.SortStableFunc(departures, CompareDepartsAt)
+
+	if args.MinMinutes != 0 || args.MaxMinutes != 0 {
+		departures = utils.Filter(departures, func(d MappedSLDeparture) bool {
+			if d.SecondsUntilDeparture == nil {
+				return false
+			}
+			seconds := *d.SecondsUntilDeparture
+			return seconds >= args.MinMinutes*60 && (args.MaxMinutes == 0 || seconds <= args.MaxMinutes*60)
+		})
+	}
+
+	if args.Limit > 0 {
+		perGroup := map[string]int{}
+		departures = utils.Filter(departures, func(d MappedSLDeparture) bool {
+			group := fmt.Sprintf("%s-%d", strings.ToUpper(d.LineDesignation), d.DirectionCode)
+			perGroup[group]++
+			return perGroup[group] <= args.Limit
+		})
+	}
+
+	return departures
+}
+
+// CompareDepartsAt orders departures by expected (or scheduled) time,
+// departures without a time last
+func CompareDepartsAt(a, b MappedSLDeparture) int {
+	aDeparts, bDeparts := departsAt(a), departsAt(b)
+
+	switch {
+	case aDeparts == nil && bDeparts == nil:
+		return 0
+	case aDeparts == nil:
+		return 1
+	case bDeparts == nil:
+		return -1
+	default:
+		return aDeparts.Compare(*bDeparts)
+	}
+}
@@ -0,0 +1,112 @@
+package sl_api
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+)
+
+const earthRadiusMetres = 6371000
+
+// a grid cell is 0.01 degrees on each side, about 1100 by 570 metres in
+// Stockholm
+const gridCellDegrees = 0.01
+
+type GetNearbySitesArgs struct {
+	Lat float64
+	Lon float64
+	// in metres
+	Radius float64
+	// 0 for every site in the radius
+	Limit int
+}
+
+type NearbySite struct {
+	Site MappedSLSite
+	// as the crow flies, in metres
+	Distance float64
+}
+
+// haversine is the distance in metres between two coordinates
+func haversine(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Pow(math.Sin(dLon/2), 2)
+
+	return 2 * earthRadiusMetres * math.Asin(math.Sqrt(a))
+}
+
+type gridCell struct {
+	lat int
+	lon int
+}
+
+func cellOf(lat float64, lon float64) gridCell {
+	return gridCell{int(math.Floor(lat / gridCellDegrees)), int(math.Floor(lon / gridCellDegrees))}
+}
+
+// siteGrid puts the sites in cells by their coordinates, so a search only
+// looks at the sites in the cells around it. It doesn't wrap around at
+// the date line, sl has no stops there
+type siteGrid map[gridCell][]MappedSLSite
+
+func newSiteGrid(sites []MappedSLSite) siteGrid {
+	grid := siteGrid{}
+	for _, site := range sites {
+		// sl leaves the coordinates out for a few sites
+		if site.Lat == 0 && site.Lon == 0 {
+			continue
+		}
+		cell := cellOf(site.Lat, site.Lon)
+		grid[cell] = append(grid[cell], site)
+	}
+	return grid
+}
+
+// nearby is the sites within args.Radius of the coordinate, closest first
+func (grid siteGrid) nearby(args GetNearbySitesArgs) []NearbySite {
+	// how many degrees the radius is, a degree of longitude gets shorter
+	// further from the equator
+	metresPerDegree := earthRadiusMetres * math.Pi / 180
+	latDegrees := args.Radius / metresPerDegree
+	lonDegrees := args.Radius / (metresPerDegree * max(math.Cos(args.Lat*math.Pi/180), 0.01))
+
+	from := cellOf(args.Lat-latDegrees, args.Lon-lonDegrees)
+	to := cellOf(args.Lat+latDegrees, args.Lon+lonDegrees)
+
+	found := []NearbySite{}
+	for lat := from.lat; lat <= to.lat; lat++ {
+		for lon := from.lon; lon <= to.lon; lon++ {
+			for _, site := range grid[gridCell{lat, lon}] {
+				distance := haversine(args.Lat, args.Lon, site.Lat, site.Lon)
+				if distance <= args.Radius {
+					found = append(found, NearbySite{Site: site, Distance: distance})
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(found, func(a, b NearbySite) int {
+		return cmp.Or(cmp.Compare(a.Distance, b.Distance), cmp.Compare(a.Site.Id, b.Site.Id))
+	})
+
+	if args.Limit > 0 && len(found) > args.Limit {
+		found = found[:args.Limit]
+	}
+	return found
+}
+
+// GetNearbySites returns the sites around a coordinate, closest first
+func (s *SLApi) GetNearbySites(ctx context.Context, args GetNearbySitesArgs) ([]NearbySite, error) {
+	index, err := s.loadSites(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return index.grid.nearby(args), nil
+}
@@ -0,0 +1,71 @@
+package sl_api_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNearbySites(t *testing.T) {
+	slApi := newSitesServer(t, []sl_api.SLApiSite{
+		{ID: 9001, Name: "T-Centralen", Lat: 59.3313, Lon: 18.0597},
+		{ID: 9117, Name: "Odenplan", Lat: 59.3429, Lon: 18.0496},
+		{ID: 9192, Name: "Slussen", Lat: 59.3195, Lon: 18.0719},
+		{ID: 9193, Name: "Gamla stan", Lat: 59.3232, Lon: 18.0676},
+		{ID: 9325, Name: "Sundbyberg", Lat: 59.3609, Lon: 17.9715},
+		{ID: 9666, Name: "Göteborg Centralstation", Lat: 57.7089, Lon: 11.9733},
+		// no coordinates from sl
+		{ID: 1, Name: "Nowhere"},
+	})
+
+	nearby := func(t *testing.T, args sl_api.GetNearbySitesArgs) ([]string, []float64) {
+		t.Helper()
+		sites, err := slApi.GetNearbySites(context.Background(), args)
+		require.NoError(t, err)
+
+		names, distances := []string{}, []float64{}
+		for _, site := range sites {
+			names = append(names, site.Site.Name)
+			distances = append(distances, site.Distance)
+		}
+		return names, distances
+	}
+
+	t.Run("closest first with the distance in metres", func(t *testing.T) {
+		names, distances := nearby(t, sl_api.GetNearbySitesArgs{Lat: 59.3313, Lon: 18.0597, Radius: 1500})
+
+		assert.Equal(t, []string{"T-Centralen", "Gamla stan", "Odenplan", "Slussen"}, names)
+		assert.InDelta(t, 0, distances[0], 1)
+		assert.InDelta(t, 1006, distances[1], 10)
+		assert.InDelta(t, 1412, distances[2], 10)
+		assert.InDelta(t, 1483, distances[3], 10)
+	})
+
+	t.Run("only sites within the radius", func(t *testing.T) {
+		names, _ := nearby(t, sl_api.GetNearbySitesArgs{Lat: 59.3313, Lon: 18.0597, Radius: 1200})
+		assert.Equal(t, []string{"T-Centralen", "Gamla stan"}, names)
+
+		names, _ = nearby(t, sl_api.GetNearbySitesArgs{Lat: 59.3609, Lon: 17.9715, Radius: 500})
+		assert.Equal(t, []string{"Sundbyberg"}, names)
+	})
+
+	t.Run("limit keeps the closest", func(t *testing.T) {
+		names, _ := nearby(t, sl_api.GetNearbySitesArgs{Lat: 59.3195, Lon: 18.0719, Radius: 5000, Limit: 2})
+		assert.Equal(t, []string{"Slussen", "Gamla stan"}, names)
+	})
+
+	t.Run("distances across many grid cells", func(t *testing.T) {
+		// Stockholm to Gothenburg is about 398 km as the crow flies
+		names, distances := nearby(t, sl_api.GetNearbySitesArgs{Lat: 59.3293, Lon: 18.0686, Radius: 400000})
+		require.Equal(t, "Göteborg Centralstation", names[len(names)-1])
+		assert.InDelta(t, 398000, distances[len(distances)-1], 2000)
+	})
+
+	t.Run("nothing nearby is an empty list", func(t *testing.T) {
+		names, _ := nearby(t, sl_api.GetNearbySitesArgs{Lat: 0, Lon: 0, Radius: 5000})
+		assert.Empty(t, names)
+	})
+}
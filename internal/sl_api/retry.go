@@ -0,0 +1,114 @@
+package sl_api
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy for calls to sl, set with WithRetryPolicy. Delays use
+// exponential backoff with full jitter, so attempt n waits a random
+// duration between 0 and min(MaxDelay, BaseDelay * 2^n). A Retry-After
+// header from sl is used instead of the backoff when present. Both are
+// on in the zero value, the fields turning them off are for when they
+// get in the way
+type RetryPolicy struct {
+	// total number of attempts, including the first one. 1 disables retries
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// wait the whole backoff instead of a random part of it
+	NoJitter bool
+	// use the backoff even when sl sends Retry-After
+	IgnoreRetryAfter bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+var NoRetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// isRetryable only retries when sl is down or asking us to slow down.
+// Everything we call is a GET so repeating it is always safe
+func isRetryable(err error) bool {
+	return errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, ErrRateLimited)
+}
+
+// backoff returns the full jitter delay before the retry following
+// attempt (0 based)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	// shifting past ~62 overflows, and we're way past MaxDelay by then anyway
+	if attempt < 32 {
+		if exp := p.BaseDelay << attempt; exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+	if p.NoJitter {
+		return ceiling
+	}
+	return rand.N(ceiling + 1)
+}
+
+// delay before the next attempt, false means we should give up, either
+// because sl wants us to wait longer than MaxDelay or because the wait
+// would outlive ctx's deadline. Loads shared through the cache have no
+// deadline of their own, they're cancelled when the last caller leaves
+// and the sleep stops then instead
+func (p RetryPolicy) delay(ctx context.Context, attempt int, err error) (time.Duration, bool) {
+	d := p.backoff(attempt)
+
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.RetryAfter > 0 && !p.IgnoreRetryAfter {
+		if upstreamErr.RetryAfter > p.MaxDelay {
+			return 0, false
+		}
+		d = upstreamErr.RetryAfter
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return 0, false
+	}
+
+	return d, true
+}
+
+// parseRetryAfter handles both formats of the header, delay in
+// seconds or a http date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0)
+	}
+
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,197 @@
+package sl_api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var fastRetries = sl_api.RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   time.Millisecond,
+	MaxDelay:    5 * time.Millisecond,
+}
+
+// newFailingServer responds with status the first failures times and
+// with body after that
+func newFailingServer(failures int32, status int, body string) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	return server, &calls
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("retries until sl succeeds", func(t *testing.T) {
+		server, calls := newFailingServer(2, http.StatusBadGateway, mockSLDeparturesResponse)
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(fastRetries))
+
+		got, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		require.NoError(t, err)
+		assert.Len(t, got.Departures, 2)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		server, calls := newFailingServer(10, http.StatusServiceUnavailable, mockSLSitesResponse)
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(fastRetries))
+
+		_, err := slApi.GetSites(context.Background(), "")
+
+		assert.ErrorIs(t, err, sl_api.ErrUpstreamUnavailable)
+		assert.Equal(t, int32(4), calls.Load())
+	})
+
+	t.Run("does not retry errors that won't go away", func(t *testing.T) {
+		server, calls := newFailingServer(10, http.StatusNotFound, mockSLDeparturesResponse)
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(fastRetries))
+
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		assert.ErrorIs(t, err, sl_api.ErrSiteNotFound)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("no retry policy makes a single attempt", func(t *testing.T) {
+		server, calls := newFailingServer(10, http.StatusBadGateway, mockSLDeparturesResponse)
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(sl_api.NoRetryPolicy))
+
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		assert.Error(t, err)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("honours retry-after", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(mockSLDeparturesResponse))
+		}))
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(sl_api.RetryPolicy{
+			MaxAttempts: 2,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    2 * time.Second,
+		}))
+
+		start := time.Now()
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("retry-after longer than max delay gives up", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(fastRetries))
+
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		assert.ErrorIs(t, err, sl_api.ErrRateLimited)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("does not wait past the callers deadline", func(t *testing.T) {
+		server, calls := newFailingServer(10, http.StatusBadGateway, mockSLDeparturesResponse)
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(sl_api.RetryPolicy{
+			MaxAttempts: 5,
+			BaseDelay:   time.Second,
+			MaxDelay:    time.Second,
+		}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := slApi.GetDepartures(ctx, sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+		assert.GreaterOrEqual(t, calls.Load(), int32(1))
+
+		// and the retries stop with the caller, they don't carry on in
+		// the background
+		after := calls.Load()
+		time.Sleep(1500 * time.Millisecond)
+		assert.Equal(t, after, calls.Load())
+	})
+
+	t.Run("without jitter the whole backoff is waited", func(t *testing.T) {
+		server, calls := newFailingServer(2, http.StatusBadGateway, mockSLDeparturesResponse)
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(sl_api.RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   50 * time.Millisecond,
+			MaxDelay:    time.Second,
+			NoJitter:    true,
+		}))
+
+		start := time.Now()
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		require.NoError(t, err)
+		// 50ms then 100ms
+		assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("retry-after can be ignored", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.Header().Set("Retry-After", "120")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(mockSLDeparturesResponse))
+		}))
+		defer server.Close()
+
+		policy := fastRetries
+		policy.IgnoreRetryAfter = true
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(policy))
+
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+}
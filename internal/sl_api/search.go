@@ -0,0 +1,328 @@
+package sl_api
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// how well a site matched a search, lower is better
+type matchRank int
+
+const (
+	// the name is the search term, "Odenplan" for "odenplan"
+	rankExact matchRank = iota
+	// "Odenplan" for "oden"
+	rankPrefix
+	// a word in the name starts with the term, "Solna strand" for "str"
+	rankWordPrefix
+	// any of the above for an alias
+	rankAlias
+	// the term is somewhere in the name or an alias
+	rankSubstring
+	// the term is a typo or two away from the start of the name or a word
+	rankTypo
+	rankNone
+)
+
+// normalizeSearch folds the value like foldName and turns punctuation
+// into spaces, so "T-Centralen" and "t centralen" are the same
+func normalizeSearch(value string) string {
+	folded := foldName(value)
+	return strings.Join(strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// maxTypos is how many typos a term of this many characters can have, a
+// typo in a short term matches too much
+func maxTypos(term string) int {
+	switch length := utf8.RuneCountInString(term); {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// searchName is a normalized name or alias, with its words split out for
+// the typo search
+type searchName struct {
+	text  string
+	words [][]rune
+}
+
+func newSearchName(value string) searchName {
+	name := searchName{text: normalizeSearch(value)}
+	for word := range strings.SplitSeq(name.text, " ") {
+		name.words = append(name.words, []rune(word))
+	}
+	return name
+}
+
+// query is a normalized search term
+type query struct {
+	text  string
+	runes []rune
+	typos int
+}
+
+func newQuery(searchTerm string) query {
+	text := normalizeSearch(searchTerm)
+	return query{text: text, runes: []rune(text), typos: maxTypos(text)}
+}
+
+// rankName is how well one name or alias matched, and how many typos it
+// took
+func rankName(name searchName, term query) (matchRank, int) {
+	switch {
+	case name.text == term.text:
+		return rankExact, 0
+	case strings.HasPrefix(name.text, term.text):
+		return rankPrefix, 0
+	case strings.Contains(name.text, " "+term.text):
+		return rankWordPrefix, 0
+	case strings.Contains(name.text, term.text):
+		return rankSubstring, 0
+	}
+
+	if term.typos == 0 {
+		return rankNone, 0
+	}
+
+	// the term is compared to the start of each word with the same number
+	// of characters, someone typing "odenpaln" hasn't typed the rest yet
+	best := term.typos + 1
+	for _, word := range name.words {
+		if len(word) > len(term.runes) {
+			word = word[:len(term.runes)]
+		}
+		best = min(best, editDistance(term.runes, word, term.typos))
+	}
+
+	if best > term.typos {
+		return rankNone, 0
+	}
+	return rankTypo, best
+}
+
+// editDistance is the levenshtein distance between a and b where swapping
+// two letters counts as one edit. It gives up and returns max + 1 once
+// the distance is more than max
+func editDistance(a []rune, b []rune, max int) int {
+	if diff := len(a) - len(b); diff > max || -diff > max {
+		return max + 1
+	}
+
+	// three rows, on the stack for the lengths of names we see
+	var buffer [3 * 32]int
+	size := len(b) + 1
+	rows := buffer[:]
+	if 3*size > len(buffer) {
+		rows = make([]int, 3*size)
+	}
+	previous, current, next := rows[:size], rows[size:2*size], rows[2*size:3*size]
+	for j := range current {
+		current[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		previous, current, next = current, next, previous
+		current[0] = i
+		rowMin := i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				current[j] = min(current[j], next[j-2]+1)
+			}
+			rowMin = min(rowMin, current[j])
+		}
+
+		if rowMin > max {
+			return max + 1
+		}
+	}
+
+	return current[len(b)]
+}
+
+type siteMatch struct {
+	site  MappedSLSite
+	rank  matchRank
+	typos int
+	// the best match was an alias
+	alias bool
+}
+
+// searchNames is the name of the site followed by its aliases
+func searchNames(site MappedSLSite) []searchName {
+	names := make([]searchName, 0, len(site.Alias)+1)
+	names = append(names, newSearchName(site.Name))
+	for _, alias := range site.Alias {
+		names = append(names, newSearchName(alias))
+	}
+	return names
+}
+
+// matchSite is the best match for term of the site's names, from
+// searchNames
+func matchSite(site MappedSLSite, names []searchName, term query) siteMatch {
+	rank, typos := rankName(names[0], term)
+	match := siteMatch{site: site, rank: rank, typos: typos}
+
+	for _, alias := range names[1:] {
+		rank, typos := rankName(alias, term)
+		// a good alias match ranks below any good name match
+		if rank < rankAlias {
+			rank = rankAlias
+		}
+		if rank < match.rank || rank == match.rank && typos < match.typos {
+			match.rank, match.typos, match.alias = rank, typos, true
+		}
+	}
+
+	return match
+}
+
+// compareMatches sorts by rank, then typos, then names before aliases,
+// then shorter names first since "Odenplan" is a better answer to "oden"
+// than "Odenplans torg"
+func compareMatches(a siteMatch, b siteMatch) int {
+	return cmp.Or(
+		cmp.Compare(a.rank, b.rank),
+		cmp.Compare(a.typos, b.typos),
+		compareBool(a.alias, b.alias),
+		cmp.Compare(utf8.RuneCountInString(a.site.Name), utf8.RuneCountInString(b.site.Name)),
+		cmp.Compare(a.site.Name, b.site.Name),
+		cmp.Compare(a.site.Id, b.site.Id),
+	)
+}
+
+func sortMatches(matches []siteMatch) []MappedSLSite {
+	slices.SortFunc(matches, compareMatches)
+
+	found := make([]MappedSLSite, len(matches))
+	for i, match := range matches {
+		found[i] = match.site
+	}
+	return found
+}
+
+// trigrams are the distinct three character pieces of value
+func trigrams(value string) []string {
+	runes := []rune(value)
+
+	var grams []string
+	for i := 0; i+3 <= len(runes); i++ {
+		gram := string(runes[i : i+3])
+		if !slices.Contains(grams, gram) {
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+// siteIndex is what we keep in the sites cache. It's built in full by
+// newSiteIndex and never changed after, so a refresh of the sites puts a
+// new index in the cache and searches still holding the old one carry on
+// with it
+type siteIndex struct {
+	sites []MappedSLSite
+	byId  map[int]MappedSLSite
+	// searchNames of sites[i]
+	names [][]searchName
+	// the positions in sites of the sites with the trigram in any of
+	// their names, in order
+	trigrams map[string][]int32
+	grid     siteGrid
+}
+
+func newSiteIndex(sites []MappedSLSite) *siteIndex {
+	index := &siteIndex{
+		sites:    sites,
+		byId:     make(map[int]MappedSLSite, len(sites)),
+		names:    make([][]searchName, len(sites)),
+		trigrams: map[string][]int32{},
+		grid:     newSiteGrid(sites),
+	}
+
+	for i, site := range sites {
+		index.byId[site.Id] = site
+		index.names[i] = searchNames(site)
+
+		for _, name := range index.names[i] {
+			for _, gram := range trigrams(name.text) {
+				positions := index.trigrams[gram]
+				// the name and an alias often share trigrams
+				if len(positions) > 0 && positions[len(positions)-1] == int32(i) {
+					continue
+				}
+				index.trigrams[gram] = append(positions, int32(i))
+			}
+		}
+	}
+
+	return index
+}
+
+// search finds the same sites as ranking every site would, in the same
+// order (SearchSites in the tests does that to check the index). Only the
+// sites that have enough of the term's trigrams are ranked: a typo changes
+// at most 4 trigrams (swapping two letters), so a site within maxTypos
+// typos of the term has all but 4 * maxTypos of them. Terms too short for
+// that to rule anything out are ranked against every site
+func (index *siteIndex) search(searchTerm string) []MappedSLSite {
+	term := newQuery(searchTerm)
+	if term.text == "" {
+		return index.sites
+	}
+
+	grams := trigrams(term.text)
+	needed := len(grams) - 4*term.typos
+
+	var matches []siteMatch
+	rank := func(i int) {
+		if match := matchSite(index.sites[i], index.names[i], term); match.rank != rankNone {
+			matches = append(matches, match)
+		}
+	}
+
+	if needed <= 0 {
+		for i := range index.sites {
+			rank(i)
+		}
+		return sortMatches(matches)
+	}
+
+	counts := make([]int, len(index.sites))
+	for _, gram := range grams {
+		for _, i := range index.trigrams[gram] {
+			counts[i]++
+			if counts[i] == needed {
+				rank(int(i))
+			}
+		}
+	}
+	return sortMatches(matches)
+}
+
+func compareBool(a bool, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
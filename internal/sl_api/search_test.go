@@ -0,0 +1,214 @@
+package sl_api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache/cachetest"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSitesServer(t *testing.T, sites []sl_api.SLApiSite) *sl_api.SLApi {
+	t.Helper()
+	body, err := json.Marshal(sites)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	return sl_api.NewSLApi(server.Client(), server.URL)
+}
+
+func TestSearchSites(t *testing.T) {
+	// sl sends them sorted by id, not by how well they match
+	slApi := newSitesServer(t, []sl_api.SLApiSite{
+		{ID: 1, Name: "Odengatan"},
+		{ID: 2, Name: "Karlbergsvägen", Alias: []string{"Odenplan norra"}},
+		{ID: 3, Name: "Stora Odenplan"},
+		{ID: 4, Name: "Odenplans torg"},
+		{ID: 5, Name: "Odenplan"},
+		{ID: 6, Name: "Södermalmstorg"},
+		{ID: 7, Name: "Södermalm"},
+		{ID: 8, Name: "T-Centralen"},
+		{ID: 9, Name: "Bagarmossen"},
+	})
+
+	search := func(t *testing.T, term string) []string {
+		t.Helper()
+		sites, err := slApi.GetSites(context.Background(), term)
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, site := range sites {
+			names = append(names, site.Name)
+		}
+		return names
+	}
+
+	t.Run("exact, prefix, word prefix, alias, then substring", func(t *testing.T) {
+		assert.Equal(t, []string{"Odenplan", "Odenplans torg", "Stora Odenplan", "Karlbergsvägen"}, search(t, "odenplan"))
+		assert.Equal(t, []string{"Stora Odenplan"}, search(t, "stora odenplan"))
+		assert.Equal(t, []string{"Karlbergsvägen"}, search(t, "norra"))
+	})
+
+	t.Run("typos are ranked last", func(t *testing.T) {
+		// "odeng" is a typo away from "odenp"
+		assert.Equal(t, []string{"Odenplan", "Odenplans torg", "Stora Odenplan", "Karlbergsvägen", "Odengatan"}, search(t, "odenp"))
+	})
+
+	t.Run("diacritics and case are ignored", func(t *testing.T) {
+		assert.Equal(t, []string{"Södermalm", "Södermalmstorg"}, search(t, "Sodermalm"))
+		assert.Equal(t, []string{"Södermalm", "Södermalmstorg"}, search(t, "SÖDERMALM"))
+	})
+
+	t.Run("punctuation is ignored", func(t *testing.T) {
+		assert.Equal(t, []string{"T-Centralen"}, search(t, "t centralen"))
+		assert.Equal(t, []string{"T-Centralen"}, search(t, "t-central"))
+	})
+
+	t.Run("small typos still match, after the exact matches", func(t *testing.T) {
+		assert.Equal(t, []string{"Odenplan", "Odenplans torg", "Stora Odenplan"}, search(t, "odenpaln")[:3])
+		assert.Equal(t, []string{"Bagarmossen"}, search(t, "bagarmosen"))
+		assert.Equal(t, []string{"Södermalm", "Södermalmstorg"}, search(t, "sodremalm"))
+	})
+
+	t.Run("short terms don't allow typos", func(t *testing.T) {
+		assert.Empty(t, search(t, "odx"))
+	})
+
+	t.Run("an empty term returns every site", func(t *testing.T) {
+		assert.Len(t, search(t, ""), 9)
+	})
+}
+
+func TestNormalizeSearch(t *testing.T) {
+	t.Run("combining marks are dropped like built in diacritics", func(t *testing.T) {
+		// o followed by a combining diaeresis instead of ö
+		assert.Equal(t, "sodermalm", sl_api.NormalizeSearch("So\u0308dermalm"))
+		assert.Equal(t, "sodermalm", sl_api.NormalizeSearch("Södermalm"))
+		assert.Equal(t, "t centralen", sl_api.NormalizeSearch("T-Centralen"))
+	})
+}
+
+// catalogue is about as many sites as sl has, with names that share a lot
+// of trigrams like the real ones do
+func catalogue() []sl_api.MappedSLSite {
+	starts := []string{
+		"Oden", "Söder", "Norr", "Väster", "Öster", "Sundby", "Hägers", "Fridhems", "Alby", "Kista",
+		"Tensta", "Hjulsta", "Skär", "Gull", "Hammar", "Brom", "Ålsten", "Älvsjö", "Farsta", "Hök",
+		"Blå", "Rinkeby", "Solna", "Bagar", "Skogs", "Mälar", "Lidingö", "Tyresö", "Nacka", "Värmdö",
+	}
+	ends := []string{
+		"plan", "torg", "gatan", "berg", "vik", "holm", "backe", "strand", "malm", "dal",
+		"gård", "hamn", "sjö", "skog", "näs", "by", "hage", "äng", "ström", "kulla",
+	}
+	extras := []string{"", " norra", " södra", " station", " centrum", " torg", " skola", " gård", " allé", " kyrka"}
+
+	var sites []sl_api.MappedSLSite
+	for _, start := range starts {
+		for _, end := range ends {
+			for _, extra := range extras {
+				name := start + end + extra
+				sites = append(sites, sl_api.MappedSLSite{
+					Id:    9000 + len(sites),
+					Name:  name,
+					Alias: []string{name + " (" + start + ")"},
+				})
+			}
+		}
+	}
+	return sites
+}
+
+var catalogueTerms = []string{
+	"odenplan", "odenp", "sodermalm", "sodremalm", "t-centralen", "torg", "station", "kulla",
+	"hagersten", "hägerstensåsen", "alvsjo", "farstastrand", "frdihem", "bagarmosen", "xyzzy", "st",
+}
+
+func TestSiteIndex(t *testing.T) {
+	t.Run("finds the same sites as searching without the index", func(t *testing.T) {
+		sites := catalogue()
+		search := sl_api.NewSiteSearch(sites)
+
+		for _, term := range catalogueTerms {
+			assert.Equal(t, sl_api.SearchSites(sites, term), search(term), term)
+		}
+	})
+
+	t.Run("searches during a refresh see a whole index", func(t *testing.T) {
+		// every refresh answers with a catalogue of n sites all named the
+		// same, a half built index would find fewer
+		var refreshes atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(refreshes.Add(1)) * 100
+			sites := make([]sl_api.SLApiSite, n)
+			for i := range sites {
+				sites[i] = sl_api.SLApiSite{ID: i, Name: fmt.Sprintf("Odenplan %d", n)}
+			}
+			json.NewEncoder(w).Encode(sites)
+		}))
+		defer server.Close()
+
+		clock := cachetest.NewFakeClock(time.Now())
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithClock(clock))
+
+		var wg sync.WaitGroup
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 20 {
+					got, err := slApi.GetSites(context.Background(), "odenplan")
+					if !assert.NoError(t, err) || !assert.NotEmpty(t, got) {
+						return
+					}
+					assert.Equal(t, fmt.Sprintf("Odenplan %d", len(got)), got[0].Name)
+				}
+			}()
+		}
+		for range 5 {
+			clock.Advance(2 * time.Hour)
+			time.Sleep(time.Millisecond)
+		}
+		wg.Wait()
+	})
+}
+
+func BenchmarkSearchSites(b *testing.B) {
+	sites := catalogue()
+
+	b.Run("without index", func(b *testing.B) {
+		for b.Loop() {
+			for _, term := range catalogueTerms {
+				sl_api.SearchSites(sites, term)
+			}
+		}
+	})
+
+	b.Run("with index", func(b *testing.B) {
+		search := sl_api.NewSiteSearch(sites)
+		for b.Loop() {
+			for _, term := range catalogueTerms {
+				search(term)
+			}
+		}
+	})
+
+	b.Run("building the index", func(b *testing.B) {
+		for b.Loop() {
+			sl_api.NewSiteSearch(sites)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package sl_api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/utils"
+)
+
+const sitesCacheKey = "sites"
+
+// how long the site index is kept before it's built again, from the site
+// store or from sl when there is no store
+const sitesCacheTime = time.Hour
+
+// how often RefreshSitesEvery asks sl, the sites change a few times a year
+const SitesRefreshInterval = 24 * time.Hour
+
+// how soon RefreshSitesEvery tries again while no sites are stored
+const sitesRetryInterval = time.Minute
+
+// SiteStore keeps the sites from sl between restarts, so we can start
+// and search without asking sl
+type SiteStore interface {
+	// Sites is every stored site, empty before the first Save
+	Sites(ctx context.Context) ([]SLApiSite, error)
+	// Save replaces the stored sites with sites
+	Save(ctx context.Context, sites []SLApiSite) (SiteChanges, error)
+	// SavedAt is when Save was last called, zero before the first Save
+	SavedAt(ctx context.Context) (time.Time, error)
+}
+
+// SiteChanges are the ids of the sites that changed in a Save
+type SiteChanges struct {
+	Added   []int
+	Removed []int
+	Changed []int
+}
+
+func (c SiteChanges) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d changed", len(c.Added), len(c.Removed), len(c.Changed))
+}
+
+// GetSites searches the sites by name and alias, best match first, see
+// siteIndex.search
+func (s *SLApi) GetSites(ctx context.Context, searchTerm string) ([]MappedSLSite, error) {
+	index, err := s.loadSites(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return index.search(searchTerm), nil
+}
+
+// GetSite returns ErrSiteNotFound for ids sl doesn't know about
+func (s *SLApi) GetSite(ctx context.Context, id int) (MappedSLSite, error) {
+	index, err := s.loadSites(ctx)
+
+	if err != nil {
+		return MappedSLSite{}, err
+	}
+
+	site, found := index.byId[id]
+	if !found {
+		return MappedSLSite{}, fmt.Errorf("no site with id %d, %w", id, ErrSiteNotFound)
+	}
+
+	return site, nil
+}
+
+func (s *SLApi) loadSites(ctx context.Context) (*siteIndex, error) {
+	return s.sitesCache.GetOrLoad(ctx, sitesCacheKey, sitesCacheTime, func(ctx context.Context) (*siteIndex, error) {
+		if s.siteStore != nil {
+			stored, err := s.siteStore.Sites(ctx)
+			if err != nil {
+				log.Printf("error reading stored sites, asking sl instead, %v", err)
+			} else if len(stored) > 0 {
+				return newSiteIndex(mapSites(stored)), nil
+			}
+		}
+
+		sites, err := s.fetchSites(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.siteStore != nil {
+			if changes, err := s.siteStore.Save(ctx, sites); err != nil {
+				log.Printf("error storing sites, %v", err)
+			} else {
+				log.Printf("stored sites from sl, %s", changes)
+			}
+		}
+		return newSiteIndex(mapSites(sites)), nil
+	})
+}
+
+// RefreshSites gets the sites from sl, saves them in the site store if
+// there is one and searches use them from now on
+func (s *SLApi) RefreshSites(ctx context.Context) (SiteChanges, error) {
+	sites, err := s.fetchSites(ctx)
+	if err != nil {
+		return SiteChanges{}, err
+	}
+
+	var changes SiteChanges
+	if s.siteStore != nil {
+		if changes, err = s.siteStore.Save(ctx, sites); err != nil {
+			return SiteChanges{}, fmt.Errorf("error storing sites, %w", err)
+		}
+	}
+
+	s.sitesCache.Set(sitesCacheKey, newSiteIndex(mapSites(sites)), sitesCacheTime)
+	return changes, nil
+}
+
+// RefreshSitesEvery calls RefreshSites every interval until ctx is done
+// or the SLApi is closed. The first refresh is an interval after the
+// stored sites were saved, so a restart doesn't ask sl again. While no
+// sites have been stored, like on a first start with sl down, it tries
+// again every sitesRetryInterval instead
+func (s *SLApi) RefreshSitesEvery(ctx context.Context, interval time.Duration) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.closing, cancel)
+	defer stop()
+
+	// without a store there's nothing to save, so nothing to hurry
+	saved := s.siteStore == nil
+	wait := interval
+	if s.siteStore != nil {
+		savedAt, err := s.siteStore.SavedAt(ctx)
+		if err != nil {
+			log.Printf("error reading when sites were stored, %v", err)
+		}
+		saved = !savedAt.IsZero()
+		if saved {
+			wait = max(interval-s.clock.Now().Sub(savedAt), 0)
+		} else {
+			wait = s.sitesRetryInterval
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		changes, err := s.RefreshSites(ctx)
+		switch {
+		case err != nil && !saved:
+			log.Printf("error refreshing sites, trying again in %s, %v", s.sitesRetryInterval, err)
+			timer.Reset(s.sitesRetryInterval)
+			continue
+		case err != nil:
+			log.Printf("error refreshing sites, %v", err)
+		default:
+			saved = true
+			log.Printf("refreshed sites from sl, %s", changes)
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (s *SLApi) fetchSites(ctx context.Context) ([]SLApiSite, error) {
+	body, err := s.get(ctx, "sites", fmt.Sprintf("%s/sites", s.baseUrl))
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting sites from sl, %w", err)
+	}
+
+	var sites []SLApiSite
+	err = json.Unmarshal(body, &sites)
+
+	if err != nil {
+		return nil, fmt.Errorf("error decoding sites to json %w", newUpstreamError(ErrUpstreamMalformed, 0, body))
+	}
+
+	// sl has thousands of sites, none is sl having a bad day. Better to
+	// keep searching the sites we have than none at all, and to not store
+	// or cache an empty list
+	if len(sites) == 0 {
+		return nil, fmt.Errorf("sl sent no sites, %w", newUpstreamError(ErrUpstreamMalformed, 0, body))
+	}
+
+	return sites, nil
+}
+
+func mapSites(sites []SLApiSite) []MappedSLSite {
+	mapSite := func(s SLApiSite) MappedSLSite {
+
+		return MappedSLSite{
+			Name: s.Name,
+			Id:   s.ID,
+			// copies the slice in to an empty slice, to avoid having
+			// null values in the json response
+			Alias: append([]string{}, s.Alias...),
+			Lat:   s.Lat,
+			Lon:   s.Lon,
+		}
+	}
+	return utils.Map(sites, mapSite)
+}
@@ -0,0 +1,262 @@
+package sl_api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSites(t *testing.T) {
+	t.Run("site by id from the cached sites", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Write([]byte(mockSLSitesResponse))
+		}))
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		_, err := slApi.GetSites(context.Background(), "Sundby")
+		require.NoError(t, err)
+
+		got, err := slApi.GetSite(context.Background(), 9326)
+		require.NoError(t, err)
+		assert.Equal(t, "Solna strand", got.Name)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("unknown site id returns site not found", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(mockSLSitesResponse))
+		}))
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		_, err := slApi.GetSite(context.Background(), 1)
+		assert.ErrorIs(t, err, sl_api.ErrSiteNotFound)
+	})
+
+	t.Run("sl errors are returned", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(sl_api.NoRetryPolicy))
+
+		_, err := slApi.GetSites(context.Background(), "Sundby")
+		assert.ErrorIs(t, err, sl_api.ErrUpstreamUnavailable)
+
+		_, err = slApi.GetSite(context.Background(), 9325)
+		assert.ErrorIs(t, err, sl_api.ErrUpstreamUnavailable)
+	})
+}
+
+// memoryStore is a sl_api.SiteStore in a slice
+type memoryStore struct {
+	mu      sync.Mutex
+	sites   []sl_api.SLApiSite
+	savedAt time.Time
+	saves   int
+}
+
+func (m *memoryStore) Sites(ctx context.Context) ([]sl_api.SLApiSite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sites, nil
+}
+
+func (m *memoryStore) Save(ctx context.Context, sites []sl_api.SLApiSite) (sl_api.SiteChanges, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sites, m.savedAt = sites, time.Now()
+	m.saves++
+	return sl_api.SiteChanges{}, nil
+}
+
+func (m *memoryStore) SavedAt(ctx context.Context) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.savedAt, nil
+}
+
+func (m *memoryStore) saveCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saves
+}
+
+func TestSiteStore(t *testing.T) {
+	newServer := func(t *testing.T, body string) (*httptest.Server, *atomic.Int32) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(server.Close)
+		return server, &calls
+	}
+
+	t.Run("stored sites are searched without asking sl", func(t *testing.T) {
+		server, calls := newServer(t, mockSLSitesResponse)
+		store := &memoryStore{sites: []sl_api.SLApiSite{{ID: 1, Name: "Odenplan"}}}
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store))
+
+		got, err := slApi.GetSites(context.Background(), "odenplan")
+		require.NoError(t, err)
+		assert.Equal(t, []sl_api.MappedSLSite{{Id: 1, Name: "Odenplan", Alias: []string{}}}, got)
+		assert.Equal(t, int32(0), calls.Load())
+	})
+
+	t.Run("sites from sl are stored when the store is empty", func(t *testing.T) {
+		server, calls := newServer(t, mockSLSitesResponse)
+		store := &memoryStore{}
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store))
+
+		got, err := slApi.GetSites(context.Background(), "Sundby")
+		require.NoError(t, err)
+		assert.Len(t, got, 1)
+		assert.Equal(t, int32(1), calls.Load())
+
+		stored, _ := store.Sites(context.Background())
+		require.Len(t, stored, 3)
+		assert.Equal(t, "SBG", stored[0].Abbreviation)
+		assert.Equal(t, []int{3431, 6031, 12346, 50242, 4543}, stored[0].StopAreas)
+		assert.Equal(t, "2017-10-11T00:00:00", stored[0].Valid.From)
+	})
+
+	t.Run("refresh stores the sites from sl and searches use them", func(t *testing.T) {
+		server, _ := newServer(t, mockSLSitesResponse)
+		store := &memoryStore{sites: []sl_api.SLApiSite{{ID: 1, Name: "Odenplan"}}}
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store))
+		_, err := slApi.GetSites(context.Background(), "")
+		require.NoError(t, err)
+
+		_, err = slApi.RefreshSites(context.Background())
+		require.NoError(t, err)
+
+		got, err := slApi.GetSites(context.Background(), "")
+		require.NoError(t, err)
+		assert.Len(t, got, 3)
+		assert.Equal(t, 1, store.saveCount())
+	})
+
+	t.Run("refresh keeps the sites when sl sends none", func(t *testing.T) {
+		server, _ := newServer(t, "[]")
+		store := &memoryStore{sites: []sl_api.SLApiSite{{ID: 1, Name: "Odenplan"}}}
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store))
+
+		_, err := slApi.RefreshSites(context.Background())
+		assert.ErrorIs(t, err, sl_api.ErrUpstreamMalformed)
+		assert.Equal(t, 0, store.saveCount())
+
+		got, err := slApi.GetSites(context.Background(), "odenplan")
+		require.NoError(t, err)
+		assert.Len(t, got, 1)
+	})
+
+	t.Run("an empty answer from sl is neither stored nor cached", func(t *testing.T) {
+		for _, body := range []string{"[]", "null"} {
+			server, calls := newServer(t, body)
+			store := &memoryStore{}
+
+			slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store))
+
+			_, err := slApi.GetSites(context.Background(), "")
+			assert.ErrorIs(t, err, sl_api.ErrUpstreamMalformed, body)
+			assert.Equal(t, 0, store.saveCount(), body)
+
+			_, err = slApi.GetSites(context.Background(), "")
+			assert.ErrorIs(t, err, sl_api.ErrUpstreamMalformed, body)
+			assert.Equal(t, int32(2), calls.Load(), body)
+		}
+	})
+
+	t.Run("refreshes once the stored sites are an interval old", func(t *testing.T) {
+		server, calls := newServer(t, mockSLSitesResponse)
+		store := &memoryStore{sites: []sl_api.SLApiSite{{ID: 1, Name: "Odenplan"}}, savedAt: time.Now().Add(-time.Hour)}
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			slApi.RefreshSitesEvery(ctx, time.Hour)
+			close(done)
+		}()
+
+		assert.Eventually(t, func() bool { return store.saveCount() == 1 }, time.Second, time.Millisecond)
+		cancel()
+		<-done
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("close stops the refreshes", func(t *testing.T) {
+		server, _ := newServer(t, mockSLSitesResponse)
+		store := &memoryStore{sites: []sl_api.SLApiSite{{ID: 1, Name: "Odenplan"}}, savedAt: time.Now()}
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store))
+
+		done := make(chan struct{})
+		go func() {
+			slApi.RefreshSitesEvery(context.Background(), time.Hour)
+			close(done)
+		}()
+
+		slApi.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("still refreshing after close")
+		}
+	})
+
+	t.Run("tries again soon while no sites are stored", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// sl is down for the first two tries
+			if calls.Add(1) <= 2 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(mockSLSitesResponse))
+		}))
+		t.Cleanup(server.Close)
+		store := &memoryStore{}
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store), sl_api.WithRetryPolicy(sl_api.NoRetryPolicy))
+		sl_api.SetSitesRetryInterval(slApi, time.Millisecond)
+		defer slApi.Close()
+
+		go slApi.RefreshSitesEvery(context.Background(), time.Hour)
+
+		assert.Eventually(t, func() bool { return store.saveCount() == 1 }, time.Second, time.Millisecond)
+		// stored now, the next try is an interval away
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("fresh stored sites are not refreshed at start", func(t *testing.T) {
+		server, calls := newServer(t, mockSLSitesResponse)
+		store := &memoryStore{sites: []sl_api.SLApiSite{{ID: 1, Name: "Odenplan"}}, savedAt: time.Now()}
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithSiteStore(store))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		slApi.RefreshSitesEvery(ctx, time.Hour)
+
+		assert.Equal(t, int32(0), calls.Load())
+	})
+}
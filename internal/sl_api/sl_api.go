@@ -1,234 +1,416 @@
 package sl_api
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"net/url"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/alexdriaguine/go-sl-time-table/internal/cache"
+	"github.com/alexdriaguine/go-sl-time-table/internal/metrics"
 	"github.com/alexdriaguine/go-sl-time-table/internal/utils"
 )
 
-// BUS, TRAM, METRO, TRAIN,
-// direction 1 or 2
-// line (number)
-// forecast
-type TransportType string
-
-// FERRY, SHIP, TAXI also exist but cba
-const (
-	TransportBus   TransportType = "BUS"
-	TransportTram  TransportType = "TRAM"
-	TransportMetro TransportType = "METRO"
-	TransportTrain TransportType = "TRAIN"
-	TransportEmpty TransportType = ""
-)
-
-func isValidTransportType(t TransportType) bool {
-	switch t {
-	case TransportBus, TransportTrain, TransportMetro, TransportTram, TransportEmpty:
-		return true
-	default:
-		return false
-	}
-}
-
 type Direction int
 
+// GetDeparturesArgs filters are sets, a departure is kept when it
+// matches one of the values of every filter that isn't empty
 type GetDeparturesArgs struct {
-	SiteId    int
-	Line      int
-	Direction int
-	Transport TransportType
+	SiteId int
+	// line designations, "43" or "43X", matched without caring about case
+	Lines []string
+	// direction codes, 1 or 2
+	Directions []int
+	Transports []TransportType
+	// only departures leaving in MinMinutes (the walk to the stop) to
+	// MaxMinutes, 0 turns the bound off. Departures without a time are
+	// dropped when either bound is set
+	MinMinutes int
+	MaxMinutes int
+	// at most Limit departures per line and direction, 0 for no limit
+	Limit int
 }
 type SLClient interface {
-	GetDepartures(GetDeparturesArgs) ([]MappedSLDeparture, error)
-	GetSites(string) ([]MappedSLSite, error)
+	GetDepartures(context.Context, GetDeparturesArgs) (DeparturesResult, error)
+	GetSites(context.Context, string) ([]MappedSLSite, error)
+	GetSite(context.Context, int) (MappedSLSite, error)
+	GetNearbySites(context.Context, GetNearbySitesArgs) ([]NearbySite, error)
+	Health() Health
+	// the caches by name, for the admin endpoints
+	Caches() map[string]cache.Admin
+}
+
+type Health struct {
+	Circuit BreakerState
 }
 
 type SLApi struct {
 	httpClient      *http.Client
 	baseUrl         string
-	sitesCache      cache.Cacher[string, []MappedSLSite]
-	departuresCache cache.Cacher[string, []MappedSLDeparture]
+	clock           cache.Clock
+	sitesCache      cache.Cacher[string, *siteIndex]
+	departuresCache *cache.StaleWhileRevalidate[string, cachedDepartures]
+	retryPolicy     RetryPolicy
+	breaker         *CircuitBreaker
+	upstreamLatency *metrics.HistogramVec
+	siteStore       SiteStore
+	// sitesRetryInterval, shorter in tests
+	sitesRetryInterval time.Duration
+	// cancelled by Close, stops the background refreshes
+	closing context.Context
+	close   context.CancelFunc
 }
 
-// Ensure implementing interface
+// Ensure implementing interfaces
 var _ SLClient = (*SLApi)(nil)
+var _ metrics.Collector = (*SLApi)(nil)
+
+type Option func(*SLApi)
+
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(s *SLApi) {
+		s.retryPolicy = policy
+	}
+}
+
+func WithCircuitBreaker(breaker *CircuitBreaker) Option {
+	return func(s *SLApi) {
+		s.breaker = breaker
+	}
+}
+
+// WithClock drives the caches, the default circuit breaker and parsing
+// of Retry-After dates
+func WithClock(clock cache.Clock) Option {
+	return func(s *SLApi) {
+		s.clock = clock
+	}
+}
+
+// WithSiteStore keeps the sites in store, they are read from it instead
+// of from sl when there are any
+func WithSiteStore(store SiteStore) Option {
+	return func(s *SLApi) {
+		s.siteStore = store
+	}
+}
 
-func NewSLApi(httpClient *http.Client, baseUrl string) *SLApi {
-	sitesCache := cache.NewCache[string, []MappedSLSite]()
-	departuresCache := cache.NewCache[string, []MappedSLDeparture]()
+func NewSLApi(httpClient *http.Client, baseUrl string, opts ...Option) *SLApi {
+	slApi := &SLApi{
+		httpClient:         httpClient,
+		baseUrl:            baseUrl,
+		clock:              cache.SystemClock{},
+		retryPolicy:        DefaultRetryPolicy,
+		sitesRetryInterval: sitesRetryInterval,
+		upstreamLatency: metrics.NewHistogramVec(
+			"sl_upstream_request_duration_seconds",
+			"Duration of requests to the SL api, every retry is observed separately",
+			metrics.DefaultBuckets,
+			"endpoint", "status",
+		),
+	}
+
+	slApi.closing, slApi.close = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(slApi)
+	}
+
+	// built after the options so they get the right clock
+	if slApi.breaker == nil {
+		slApi.breaker = NewCircuitBreaker(DefaultBreakerConfig, slApi.clock)
+	}
+
+	slApi.sitesCache = cache.NewCache(cache.WithClock[string, *siteIndex](slApi.clock))
+	slApi.departuresCache = cache.NewStaleWhileRevalidate(
+		cache.NewCache(
+			cache.WithClock[string, cachedDepartures](slApi.clock),
+			cache.WithMaxEntries[string, cachedDepartures](departuresCacheMaxEntries),
+			cache.WithJanitor[string, cachedDepartures](departuresStaleTime),
+		),
+		departuresCacheTiime,
+		departuresStaleTime,
+	)
 
-	return &SLApi{httpClient, baseUrl, sitesCache, departuresCache}
+	return slApi
 }
 
 const baseUrl = "https://transport.integration.sl.se/v1"
 const defaultTimeout = 10 * time.Second
 
-func NewDefaultSLApi() *SLApi {
+// NewDefaultSLApi talks to sl. With a site store the sites are read from
+// it at start and refreshed from sl every SitesRefreshInterval, without
+// one they are asked for at start
+func NewDefaultSLApi(opts ...Option) *SLApi {
 	slApi := NewSLApi(
 		&http.Client{Timeout: defaultTimeout},
 		baseUrl,
+		opts...,
 	)
 
 	log.Println("warming up sites cache")
-	_, err := slApi.GetSites("")
+	_, err := slApi.GetSites(context.Background(), "")
 
 	if err != nil {
 		log.Println("error fetching sites for cache..")
 	}
 
+	if slApi.siteStore != nil {
+		go slApi.RefreshSitesEvery(context.Background(), SitesRefreshInterval)
+	}
+
 	return slApi
 }
 
 const departuresCacheTiime = 5 * time.Second
 
+// departures older than this are too far off to show, even when sl is down
+const departuresStaleTime = time.Minute
+
+// every site gets its own entry, so without a bound anyone iterating
+// over sites grows the cache forever
+const departuresCacheMaxEntries = 5000
+
 var ErrInvalidTransportType = errors.New("invalid transport-type")
 
-func (s *SLApi) GetDepartures(args GetDeparturesArgs) ([]MappedSLDeparture, error) {
+// GetDepartures serves cached departures for up to departuresStaleTime,
+// anything older than departuresCacheTiime is marked stale and refreshed
+// in the background
+func (s *SLApi) GetDepartures(ctx context.Context, args GetDeparturesArgs) (DeparturesResult, error) {
 
-	if !isValidTransportType(args.Transport) {
-		return nil, fmt.Errorf("could not parse transport %s, %w", args.Transport, ErrInvalidTransportType)
+	for _, transport := range args.Transports {
+		if !isValidTransportType(transport) {
+			return DeparturesResult{}, fmt.Errorf("could not parse transport %s, %w", transport, ErrInvalidTransportType)
+		}
 	}
 
-	cacheKey := buildCacheKey(args)
-	fmt.Println("cache key")
-	fmt.Println(cacheKey)
-	cached, found := s.departuresCache.Get(cacheKey)
+	cacheKey := buildCacheKey(args.SiteId)
 
-	if found {
-		return cached, nil
-	}
+	entry, err := s.departuresCache.GetOrLoad(ctx, cacheKey, func(ctx context.Context) (cachedDepartures, error) {
+		return s.fetchDepartures(ctx, args.SiteId)
+	})
 
-	params := url.Values{}
-	if args.Transport != TransportEmpty {
-		params.Add("transport", string(args.Transport))
-	}
-	if args.Line != 0 {
-		params.Add("line", strconv.Itoa(args.Line))
-	}
-	if args.Direction > 0 && args.Direction <= 2 {
-		params.Add("direction", strconv.Itoa(args.Direction))
+	if err != nil {
+		return DeparturesResult{}, err
 	}
 
-	queryString := params.Encode()
+	return DeparturesResult{
+		Departures:     limitDepartures(withCountdown(filterDepartures(entry.Value.departures, args), s.clock.Now()), args),
+		StopDeviations: entry.Value.stopDeviations,
+		Age:            entry.Age,
+		Stale:          entry.Stale,
+	}, nil
+}
 
-	res, err := s.httpClient.Get(fmt.Sprintf("%s/sites/%d/departures?%s", s.baseUrl, args.SiteId, queryString))
+// what we keep in the departures cache, everything from one call to sl
+type cachedDepartures struct {
+	departures     []MappedSLDeparture
+	stopDeviations []MappedSLStopDeviation
+}
+
+func (s *SLApi) fetchDepartures(ctx context.Context, siteId int) (cachedDepartures, error) {
+	body, err := s.get(ctx, "departures", fmt.Sprintf("%s/sites/%d/departures", s.baseUrl, siteId))
 
 	if err != nil {
-		return nil, fmt.Errorf("error getting departures from sl, %w", err)
+		return cachedDepartures{}, fmt.Errorf("error getting departures from sl, %w", err)
 	}
-	defer res.Body.Close()
 
 	var d SLApiDepartures
-	err = json.NewDecoder(res.Body).Decode(&d)
+	err = json.Unmarshal(body, &d)
 
 	if err != nil {
-		return nil, fmt.Errorf("error decoding json for departures, %w", err)
+		return cachedDepartures{}, fmt.Errorf("error decoding json for departures, %w", newUpstreamError(ErrUpstreamMalformed, 0, body))
 	}
 
-	mappedDepartures := mapDepartures(d.Departures)
-	s.departuresCache.Set(cacheKey, mappedDepartures, departuresCacheTiime)
+	// a valid response always has the departures array, even when empty.
+	// without this any json object would be cached as zero departures
+	if d.Departures == nil {
+		return cachedDepartures{}, fmt.Errorf("departures missing in response, %w", newUpstreamError(ErrUpstreamMalformed, 0, body))
+	}
 
-	return mappedDepartures, nil
+	return cachedDepartures{
+		departures:     mapDepartures(d.Departures),
+		stopDeviations: mapStopDeviations(d.StopDeviations),
+	}, nil
 }
 
-func buildCacheKey(args GetDeparturesArgs) string {
-	key := fmt.Sprintf(
-		"sites-%d-%d-%d-%s",
-		args.SiteId,
-		args.Line,
-		args.Direction,
-		args.Transport,
-	)
-	return key
+// Close stops the background sweeping of the departures cache and the
+// refreshes of the sites
+func (s *SLApi) Close() {
+	s.close()
+	s.departuresCache.Close()
 }
 
-const sitesCacheKey = "sites"
-const sitesCacheTime = 10 * time.Second
-
-func (s *SLApi) GetSites(searchTerm string) ([]MappedSLSite, error) {
-	cachedSites, found := s.sitesCache.Get(sitesCacheKey)
-	if found {
-		log.Println("cache hit: sites")
-		return filterSitesBySearchTerm(cachedSites, searchTerm), nil
+func (s *SLApi) Caches() map[string]cache.Admin {
+	return map[string]cache.Admin{
+		"sites":      s.sitesCache,
+		"departures": s.departuresCache.Cache(),
 	}
+}
 
-	log.Println("cache miss: sites")
-	res, err := s.httpClient.Get(fmt.Sprintf("%s/sites", s.baseUrl))
+func (s *SLApi) Health() Health {
+	return Health{Circuit: s.breaker.State()}
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("error getting sites from sl, %w", err)
-	}
+// we fetch everything for the site and filter after the cache, so one
+// entry serves every combination of lines, directions and transports
+func buildCacheKey(siteId int) string {
+	return fmt.Sprintf("sites-%d", siteId)
+}
 
-	defer res.Body.Close()
+// get calls sl through the circuit breaker and retries according to the
+// retry policy. Non 2xx responses are returned as an UpstreamError.
+// endpoint is only used to label the latency metrics
+func (s *SLApi) get(ctx context.Context, endpoint string, url string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		if err := s.breaker.Allow(); err != nil {
+			return nil, err
+		}
 
-	var sites []SLApiSite
-	err = json.NewDecoder(res.Body).Decode(&sites)
+		start := time.Now()
+		body, status, err := s.getOnce(ctx, url)
+		s.upstreamLatency.Observe(time.Since(start).Seconds(), endpoint, statusLabel(status))
 
-	if err != nil {
-		return nil, fmt.Errorf("error decoding sites to json %w", err)
-	}
+		if ctx.Err() != nil {
+			s.breaker.Skip()
+		} else {
+			s.breaker.Record(countsAsFailure(err))
+		}
 
-	mappedSites := mapSites(sites)
+		if err == nil || !isRetryable(err) || attempt+1 >= s.retryPolicy.MaxAttempts {
+			return body, err
+		}
 
-	s.sitesCache.Set(sitesCacheKey, mappedSites, sitesCacheTime)
-	filteredSites := filterSitesBySearchTerm(mappedSites, searchTerm)
+		delay, ok := s.retryPolicy.delay(ctx, attempt, err)
+		if !ok {
+			return nil, err
+		}
 
-	return filteredSites, nil
+		log.Printf("retrying request to sl in %s (attempt %d), %v", delay, attempt+1, err)
+		if sleepErr := sleep(ctx, delay); sleepErr != nil {
+			return nil, sleepErr
+		}
+	}
 }
 
-func mapSites(sites []SLApiSite) []MappedSLSite {
-	mapSite := func(s SLApiSite) MappedSLSite {
+// getOnce builds the request with the callers context, so that a cancelled
+// request (browser closing the connection etc) or a deadline also
+// aborts the call to SL. status is 0 when we never got a response
+func (s *SLApi) getOnce(ctx context.Context, url string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		return MappedSLSite{
-			Name: s.Name,
-			Id:   s.ID,
-			// copies the slice in to an empty slice, to avoid having
-			// null values in the json response
-			Alias: append([]string{}, s.Alias...),
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		// a cancelled or timed out context is the callers doing, not sl being down
+		if ctx.Err() != nil {
+			return nil, 0, err
 		}
+		return nil, 0, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
 	}
-	return utils.Map(sites, mapSite)
-}
-
-func filterSitesBySearchTerm(sites []MappedSLSite, searchTerm string) []MappedSLSite {
-	filterSite := func(s MappedSLSite) bool {
+	defer res.Body.Close()
 
-		nameMatches := strings.Contains(strings.ToLower(s.Name), strings.ToLower(searchTerm))
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("%w: error reading body, %w", ErrUpstreamUnavailable, err)
+	}
 
-		if nameMatches {
-			return true
+	if err := checkStatus(res.StatusCode, body); err != nil {
+		var upstreamErr *UpstreamError
+		if errors.As(err, &upstreamErr) {
+			upstreamErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), s.clock.Now())
 		}
+		return nil, res.StatusCode, err
+	}
 
-		anyAliasMatches := utils.Filter(s.Alias, func(s string) bool {
-			return strings.Contains(strings.ToLower(s), strings.ToLower(searchTerm))
-		})
+	return body, res.StatusCode, nil
+}
 
-		return len(anyAliasMatches) > 0
+func statusLabel(status int) string {
+	if status == 0 {
+		return "error"
 	}
+	return strconv.Itoa(status)
+}
 
-	return utils.Filter(sites, filterSite)
+// Collect implements metrics.Collector with the latency of calls to sl,
+// the cache metrics are collected through Caches
+func (s *SLApi) Collect() []metrics.Family {
+	return s.upstreamLatency.Collect()
 }
 
 func mapDepartures(departures []SLApiDeparture) []MappedSLDeparture {
 
 	mapDeparture := func(d SLApiDeparture) MappedSLDeparture {
-		return MappedSLDeparture{
-			Destination:   d.Destination,
-			Display:       d.Display,
-			LineNumber:    d.Line.ID,
-			TransportMode: d.Line.TransportMode,
-			GroupOfLines:  d.Line.GroupOfLines,
-			State:         d.State,
+		mapped := MappedSLDeparture{
+			Destination:     d.Destination,
+			Display:         d.Display,
+			LineNumber:      d.Line.ID,
+			LineDesignation: d.Line.Designation,
+			TransportMode:   d.Line.TransportMode,
+			GroupOfLines:    d.Line.GroupOfLines,
+			State:           d.State,
+			DirectionCode:   d.DirectionCode,
+			StopArea: MappedSLStopArea{
+				Id:   d.StopArea.ID,
+				Name: d.StopArea.Name,
+				Type: d.StopArea.Type,
+			},
+			StopPoint: MappedSLStopPoint{
+				Id:          d.StopPoint.ID,
+				Name:        d.StopPoint.Name,
+				Designation: d.StopPoint.Designation,
+			},
+			Journey: MappedSLJourney{
+				Id:              d.Journey.ID,
+				State:           d.Journey.State,
+				PredictionState: d.Journey.PredictionState,
+			},
+			Deviations: mapDeviations(d.Deviations),
 		}
+		parseDepartureTimes(&mapped, d)
+		return mapped
 	}
 	return utils.Map(departures, mapDeparture)
 }
+
+func mapDeviations(deviations []SLApiDeviation) []MappedSLDeviation {
+	mapDeviation := func(d SLApiDeviation) MappedSLDeviation {
+		return MappedSLDeviation{
+			ImportanceLevel: d.ImportanceLevel,
+			Consequence:     d.Consequence,
+			Message:         d.Message,
+		}
+	}
+	return utils.Map(deviations, mapDeviation)
+}
+
+// mapStopDeviations sorts the deviations with the highest importance
+// level first, ties keep the order sl sent them in
+func mapStopDeviations(deviations []SLApiStopDeviation) []MappedSLStopDeviation {
+	mapDeviation := func(d SLApiStopDeviation) MappedSLStopDeviation {
+		return MappedSLStopDeviation{
+			Id:              d.ID,
+			ImportanceLevel: d.ImportanceLevel,
+			Message:         d.Message,
+			Lines: utils.Map(d.Scope.Lines, func(l SLApiScopeLine) string {
+				return l.Designation
+			}),
+		}
+	}
+
+	mapped := utils.Map(deviations, mapDeviation)
+	slices.SortStableFunc(mapped, func(a, b MappedSLStopDeviation) int {
+		return cmp.Compare(b.ImportanceLevel, a.ImportanceLevel)
+	})
+	return mapped
+}
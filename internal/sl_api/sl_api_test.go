@@ -1,45 +1,259 @@
 package sl_api_test
 
 import (
+	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alexdriaguine/go-sl-time-table/internal/cache/cachetest"
+	"github.com/alexdriaguine/go-sl-time-table/internal/metrics"
+	"github.com/alexdriaguine/go-sl-time-table/internal/metrics/metricstest"
 	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+var stockholm, _ = time.LoadLocation("Europe/Stockholm")
+
+// withoutTimes clears the parsed times so the rest of the departure can
+// be compared with a plain struct
+func withoutTimes(departures []sl_api.MappedSLDeparture) []sl_api.MappedSLDeparture {
+	cleared := []sl_api.MappedSLDeparture{}
+	for _, d := range departures {
+		d.Scheduled, d.Expected, d.DelaySeconds, d.SecondsUntilDeparture = nil, nil, nil, nil
+		cleared = append(cleared, d)
+	}
+	return cleared
+}
+
 func TestSLApi(t *testing.T) {
 	t.Run("Happy path", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(mockSLDeparturesResponse))
 		}))
 
-		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+		clock := cachetest.NewFakeClock(time.Date(2025, 10, 15, 20, 10, 0, 0, stockholm))
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithClock(clock))
 
-		got, err := slApi.GetDepartures(sl_api.GetDeparturesArgs{SiteId: 9325})
+		got, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
 		require.NoError(t, err)
 		want := []sl_api.MappedSLDeparture{
 			{
-				Destination:   "Västerhaninge",
-				Display:       "Nu",
-				LineNumber:    43,
-				TransportMode: "TRAIN",
-				GroupOfLines:  "Pendeltåg",
-				State:         "ATSTOP",
+				Destination:     "Västerhaninge",
+				Display:         "Nu",
+				LineNumber:      43,
+				LineDesignation: "43",
+				TransportMode:   "TRAIN",
+				GroupOfLines:    "Pendeltåg",
+				State:           "ATSTOP",
+				DirectionCode:   1,
+				StopArea:        sl_api.MappedSLStopArea{Id: 6031, Name: "Sundbyberg", Type: "RAILWSTN"},
+				StopPoint:       sl_api.MappedSLStopPoint{Id: 6031, Name: "Sundbyberg", Designation: "3"},
+				Journey:         sl_api.MappedSLJourney{Id: 2025101502865, State: "NORMALPROGRESS", PredictionState: "NORMAL"},
+				Deviations:      []sl_api.MappedSLDeviation{},
 			},
 			{
-				Destination:   "Odenplan",
-				Display:       "1 min",
-				LineNumber:    515,
-				TransportMode: "BUS",
-				GroupOfLines:  "",
-				State:         "EXPECTED",
+				Destination:     "Odenplan",
+				Display:         "1 min",
+				LineNumber:      515,
+				LineDesignation: "515",
+				TransportMode:   "BUS",
+				GroupOfLines:    "",
+				State:           "EXPECTED",
+				DirectionCode:   2,
+				StopArea:        sl_api.MappedSLStopArea{Id: 12346, Name: "Sundbybergs station", Type: "BUSTERM"},
+				StopPoint:       sl_api.MappedSLStopPoint{Id: 50439, Name: "Sundbybergs station", Designation: "A"},
+				Journey:         sl_api.MappedSLJourney{Id: 2025101500140, State: "EXPECTED"},
+				Deviations:      []sl_api.MappedSLDeviation{},
 			},
 		}
 
-		require.Equal(t, got, want)
+		require.Equal(t, withoutTimes(got.Departures), want)
+		assert.Equal(t, []sl_api.MappedSLStopDeviation{}, got.StopDeviations)
+		assert.False(t, got.Stale)
+
+		first := got.Departures[0]
+		assert.Equal(t, "2025-10-15T20:11:00+02:00", first.Scheduled.Format(time.RFC3339))
+		assert.Equal(t, "2025-10-15T20:11:00+02:00", first.Expected.Format(time.RFC3339))
+		assert.Equal(t, 0, *first.DelaySeconds)
+		assert.Equal(t, 60, *first.SecondsUntilDeparture)
+		assert.Equal(t, 180, *got.Departures[1].SecondsUntilDeparture)
+	})
+
+	t.Run("maps departure and stop deviations, most important first", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{
+				"departures": [{"deviations": [
+					{"importance_level": 5, "consequence": "CANCELLED", "message": "Inställd"}
+				]}],
+				"stop_deviations": [
+					{"id": 1, "importance_level": 2, "message": "Hiss ur funktion"},
+					{"id": 2, "importance_level": 7, "message": "Ersättningsbussar", "scope": {"lines": [{"designation": "43"}, {"designation": "44"}]}},
+					{"id": 3, "importance_level": 2, "message": "Rulltrappa ur funktion"}
+				]
+			}`))
+		}))
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		got, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		require.NoError(t, err)
+
+		require.Len(t, got.Departures, 1)
+		assert.Equal(t, []sl_api.MappedSLDeviation{
+			{ImportanceLevel: 5, Consequence: "CANCELLED", Message: "Inställd"},
+		}, got.Departures[0].Deviations)
+
+		assert.Equal(t, []sl_api.MappedSLStopDeviation{
+			{Id: 2, ImportanceLevel: 7, Message: "Ersättningsbussar", Lines: []string{"43", "44"}},
+			{Id: 1, ImportanceLevel: 2, Message: "Hiss ur funktion", Lines: []string{}},
+			{Id: 3, ImportanceLevel: 2, Message: "Rulltrappa ur funktion", Lines: []string{}},
+		}, got.StopDeviations)
+	})
+
+	t.Run("line designations that aren't numbers are kept", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"departures": [
+				{"line": {"id": 43, "designation": "43X"}, "journey": {"id": 1, "prediction_state": "UNRELIABLE"}}
+			]}`))
+		}))
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		got, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		require.NoError(t, err)
+		require.Len(t, got.Departures, 1)
+		assert.Equal(t, "43X", got.Departures[0].LineDesignation)
+		assert.Equal(t, "UNRELIABLE", got.Departures[0].Journey.PredictionState)
+	})
+
+	t.Run("filters lines, directions and transports after a single fetch", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			assert.Empty(t, r.URL.RawQuery)
+			w.Write([]byte(`{"departures": [
+				{"destination": "Tumba", "direction_code": 2, "line": {"designation": "43", "transport_mode": "TRAIN"}},
+				{"destination": "Bålsta", "direction_code": 1, "line": {"designation": "43X", "transport_mode": "TRAIN"}},
+				{"destination": "Södertälje", "direction_code": 2, "line": {"designation": "44", "transport_mode": "TRAIN"}},
+				{"destination": "Slussen", "direction_code": 2, "line": {"designation": "N1", "transport_mode": "BUS"}},
+				{"destination": "Odenplan", "direction_code": 1, "line": {"designation": "515", "transport_mode": "BUS"}}
+			]}`))
+		}))
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+		destinations := func(args sl_api.GetDeparturesArgs) []string {
+			got, err := slApi.GetDepartures(context.Background(), args)
+			require.NoError(t, err)
+			names := []string{}
+			for _, d := range got.Departures {
+				names = append(names, d.Destination)
+			}
+			return names
+		}
+
+		assert.Equal(t, []string{"Bålsta"}, destinations(sl_api.GetDeparturesArgs{SiteId: 9325, Lines: []string{"43x"}}))
+		assert.Equal(t, []string{"Tumba", "Södertälje"}, destinations(sl_api.GetDeparturesArgs{
+			SiteId:     9325,
+			Lines:      []string{"43", "44"},
+			Directions: []int{2},
+		}))
+		assert.Equal(t, []string{"Slussen", "Odenplan"}, destinations(sl_api.GetDeparturesArgs{
+			SiteId:     9325,
+			Transports: []sl_api.TransportType{sl_api.TransportBus, sl_api.TransportFerry},
+		}))
+		assert.Len(t, destinations(sl_api.GetDeparturesArgs{SiteId: 9325}), 5)
+
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("time window and limit per line and direction, sorted by expected time", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"departures": [
+				{"destination": "late", "expected": "2025-01-15T09:10:00", "direction_code": 1, "line": {"designation": "43"}},
+				{"destination": "now", "expected": "2025-01-15T08:00:30", "direction_code": 1, "line": {"designation": "43"}},
+				{"destination": "no time", "direction_code": 1, "line": {"designation": "43"}},
+				{"destination": "walkable", "scheduled": "2025-01-15T08:06:00", "direction_code": 1, "line": {"designation": "43"}},
+				{"destination": "delayed", "scheduled": "2025-01-15T08:05:00", "expected": "2025-01-15T08:08:00", "direction_code": 1, "line": {"designation": "43"}},
+				{"destination": "other way", "expected": "2025-01-15T08:20:00", "direction_code": 2, "line": {"designation": "43"}},
+				{"destination": "other line", "expected": "2025-01-15T08:07:00", "direction_code": 1, "line": {"designation": "44"}}
+			]}`))
+		}))
+
+		clock := cachetest.NewFakeClock(time.Date(2025, 1, 15, 8, 0, 0, 0, stockholm))
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithClock(clock))
+		destinations := func(args sl_api.GetDeparturesArgs) []string {
+			got, err := slApi.GetDepartures(context.Background(), args)
+			require.NoError(t, err)
+			names := []string{}
+			for _, d := range got.Departures {
+				names = append(names, d.Destination)
+			}
+			return names
+		}
+
+		assert.Equal(t,
+			[]string{"now", "walkable", "other line", "delayed", "other way", "late", "no time"},
+			destinations(sl_api.GetDeparturesArgs{SiteId: 9325}),
+		)
+		assert.Equal(t,
+			[]string{"walkable", "other line", "delayed", "other way"},
+			destinations(sl_api.GetDeparturesArgs{SiteId: 9325, MinMinutes: 5, MaxMinutes: 60}),
+		)
+		assert.Equal(t,
+			[]string{"walkable", "other line", "other way"},
+			destinations(sl_api.GetDeparturesArgs{SiteId: 9325, MinMinutes: 5, Limit: 1}),
+		)
+
+		clock.Advance(10 * time.Minute)
+		assert.Equal(t,
+			[]string{"other way", "late"},
+			destinations(sl_api.GetDeparturesArgs{SiteId: 9325, MinMinutes: 5}),
+		)
+	})
+
+	t.Run("delay and countdown follow the clock", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"departures": [
+				{"scheduled": "2025-01-15T08:00:00", "expected": "2025-01-15T08:03:30"},
+				{"scheduled": "2025-01-15T08:05:00"},
+				{"scheduled": "not a time", "expected": "2025-01-15T08:10:00"}
+			]}`))
+		}))
+		defer server.Close()
+
+		clock := cachetest.NewFakeClock(time.Date(2025, 1, 15, 8, 0, 0, 0, stockholm))
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithClock(clock))
+
+		got, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		require.NoError(t, err)
+
+		delayed := got.Departures[0]
+		assert.Equal(t, "2025-01-15T08:03:30+01:00", delayed.Expected.Format(time.RFC3339))
+		assert.Equal(t, 210, *delayed.DelaySeconds)
+		assert.Equal(t, 210, *delayed.SecondsUntilDeparture)
+
+		// no expected time, count down to the scheduled one
+		noExpected := got.Departures[1]
+		assert.Nil(t, noExpected.Expected)
+		assert.Nil(t, noExpected.DelaySeconds)
+		assert.Equal(t, 300, *noExpected.SecondsUntilDeparture)
+
+		unparseable := got.Departures[2]
+		assert.Nil(t, unparseable.Scheduled)
+		assert.Nil(t, unparseable.DelaySeconds)
+		assert.Equal(t, 600, *unparseable.SecondsUntilDeparture)
+
+		// served from the cache, but counted from the new now
+		clock.Advance(2 * time.Second)
+		got, err = slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		require.NoError(t, err)
+		assert.Equal(t, 208, *got.Departures[0].SecondsUntilDeparture)
 	})
 
 	t.Run("non 200 status code returns error", func(t *testing.T) {
@@ -49,10 +263,74 @@ func TestSLApi(t *testing.T) {
 
 		slApi := sl_api.NewSLApi(server.Client(), server.URL)
 
-		_, err := slApi.GetDepartures(sl_api.GetDeparturesArgs{SiteId: 9325})
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
 		require.Error(t, err)
 	})
 
+	t.Run("upstream status codes map to typed errors", func(t *testing.T) {
+		cases := []struct {
+			status int
+			want   error
+		}{
+			{http.StatusNotFound, sl_api.ErrSiteNotFound},
+			{http.StatusTooManyRequests, sl_api.ErrRateLimited},
+			{http.StatusBadGateway, sl_api.ErrUpstreamUnavailable},
+			{http.StatusServiceUnavailable, sl_api.ErrUpstreamUnavailable},
+			{http.StatusBadRequest, sl_api.ErrUpstreamMalformed},
+		}
+
+		for _, c := range cases {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.status)
+				w.Write([]byte(`{"message": "nope"}`))
+			}))
+
+			slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+			_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+			server.Close()
+
+			assert.ErrorIs(t, err, c.want, "status %d", c.status)
+
+			var upstreamErr *sl_api.UpstreamError
+			require.ErrorAs(t, err, &upstreamErr)
+			assert.Equal(t, c.status, upstreamErr.StatusCode)
+			assert.Equal(t, `{"message": "nope"}`, upstreamErr.Body)
+		}
+	})
+
+	t.Run("json error body with 200 is not cached as empty departures", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.Write([]byte(`{"message": "something went wrong"}`))
+				return
+			}
+			w.Write([]byte(mockSLDeparturesResponse))
+		}))
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		assert.ErrorIs(t, err, sl_api.ErrUpstreamMalformed)
+
+		got, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		require.NoError(t, err)
+		assert.Len(t, got.Departures, 2)
+	})
+
+	t.Run("unreachable sl returns upstream unavailable", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		_, err := slApi.GetSites(context.Background(), "")
+		assert.ErrorIs(t, err, sl_api.ErrUpstreamUnavailable)
+	})
+
 	t.Run("can return sites", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(mockSLSitesResponse))
@@ -60,7 +338,7 @@ func TestSLApi(t *testing.T) {
 
 		slApi := sl_api.NewSLApi(server.Client(), server.URL)
 
-		got, err := slApi.GetSites("Sundby")
+		got, err := slApi.GetSites(context.Background(), "Sundby")
 		want := []sl_api.MappedSLSite{
 			{
 				Name: "Sundbyberg",
@@ -70,6 +348,8 @@ func TestSLApi(t *testing.T) {
 					"Sundbybergs station",
 					"Sundbybergs torg",
 				},
+				Lat: 59.3608711069539,
+				Lon: 17.9714916630653,
 			},
 		}
 		assert.NoError(t, err)
@@ -83,11 +363,140 @@ func TestSLApi(t *testing.T) {
 
 		slApi := sl_api.NewSLApi(server.Client(), server.URL)
 
-		_, err := slApi.GetDepartures(sl_api.GetDeparturesArgs{SiteId: 9325, Transport: "rocket"})
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325, Transports: []sl_api.TransportType{"rocket"}})
 
 		assert.Error(t, err)
 	})
 
+	t.Run("concurrent requests for the same site make one call to sl", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			if r.URL.Path == "/sites" {
+				w.Write([]byte(mockSLSitesResponse))
+				return
+			}
+			w.Write([]byte(mockSLDeparturesResponse))
+		}))
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		var wg sync.WaitGroup
+		for range 50 {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				got, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+				assert.NoError(t, err)
+				assert.Len(t, got.Departures, 2)
+			}()
+			go func() {
+				defer wg.Done()
+				got, err := slApi.GetSites(context.Background(), "Sundby")
+				assert.NoError(t, err)
+				assert.Len(t, got, 1)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("departures are served stale past the cache time", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(mockSLDeparturesResponse))
+		}))
+		defer server.Close()
+
+		clock := cachetest.NewFakeClock(time.Now())
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithClock(clock))
+		defer slApi.Close()
+
+		got, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		require.NoError(t, err)
+		assert.False(t, got.Stale)
+
+		clock.Advance(8 * time.Second)
+
+		got, err = slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		require.NoError(t, err)
+		assert.True(t, got.Stale)
+		assert.Equal(t, 8*time.Second, got.Age)
+		assert.Len(t, got.Departures, 2)
+	})
+
+	t.Run("observes upstream latency per endpoint and status", func(t *testing.T) {
+		server, _ := newFailingServer(1, http.StatusBadGateway, mockSLDeparturesResponse)
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL, sl_api.WithRetryPolicy(fastRetries))
+		_, err := slApi.GetDepartures(context.Background(), sl_api.GetDeparturesArgs{SiteId: 9325})
+		require.NoError(t, err)
+
+		registry := metrics.NewRegistry()
+		registry.Register(slApi)
+		var buf bytes.Buffer
+		registry.WriteText(&buf)
+
+		parsed, err := metricstest.Parse(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, "histogram", parsed.Types["sl_upstream_request_duration_seconds"])
+		assert.Equal(t, 1.0, parsed.Values[`sl_upstream_request_duration_seconds_count{endpoint="departures",status="502"}`])
+		assert.Equal(t, 1.0, parsed.Values[`sl_upstream_request_duration_seconds_count{endpoint="departures",status="200"}`])
+	})
+
+	t.Run("cancelled context aborts the request", func(t *testing.T) {
+		var called atomic.Bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called.Store(true)
+			w.Write([]byte(mockSLDeparturesResponse))
+		}))
+		defer server.Close()
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := slApi.GetDepartures(ctx, sl_api.GetDeparturesArgs{SiteId: 9325})
+		// waits for any request that did get through
+		server.Close()
+
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.False(t, called.Load())
+	})
+
+	t.Run("context deadline reaches the upstream request", func(t *testing.T) {
+		release := make(chan struct{})
+		upstreamCancelled := make(chan struct{}, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				upstreamCancelled <- struct{}{}
+			case <-release:
+			}
+		}))
+		defer server.Close()
+		defer close(release)
+
+		slApi := sl_api.NewSLApi(server.Client(), server.URL)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := slApi.GetSites(ctx, "")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		select {
+		case <-upstreamCancelled:
+		case <-time.After(time.Second):
+			t.Fatal("the request to sl wasn't cancelled")
+		}
+	})
+
 }
 
 const mockSLSitesResponse = `[
@@ -1,18 +1,79 @@
 package sl_api
 
+import "time"
+
+type DeparturesResult struct {
+	Departures []MappedSLDeparture
+	// deviations for the whole stop, most important first
+	StopDeviations []MappedSLStopDeviation
+	// how old the departures are, 0 when just fetched from sl
+	Age time.Duration
+	// past the cache time and being refreshed in the background
+	Stale bool
+}
+
 type MappedSLDeparture struct {
-	Destination   string
-	Display       string
-	LineNumber    int
-	TransportMode string
-	GroupOfLines  string
-	State         string
+	Destination string
+	Display     string
+	// sl's Line.ID, filters and groups go by LineDesignation
+	LineNumber      int
+	LineDesignation string
+	TransportMode   string
+	GroupOfLines    string
+	State           string
+	DirectionCode   int
+	StopArea        MappedSLStopArea
+	StopPoint       MappedSLStopPoint
+	Journey         MappedSLJourney
+	// set by parseDepartureTimes when mapping
+	Scheduled    *time.Time
+	Expected     *time.Time
+	DelaySeconds *int
+	// nil in the cache, withCountdown sets it on the copies we hand out
+	SecondsUntilDeparture *int
+	Deviations            []MappedSLDeviation
+}
+
+type MappedSLStopArea struct {
+	Id   int
+	Name string
+	Type string
+}
+
+type MappedSLStopPoint struct {
+	Id          int
+	Name        string
+	Designation string
+}
+
+type MappedSLJourney struct {
+	Id    int64
+	State string
+	// NORMAL, or something else when sl doesn't trust the expected time
+	PredictionState string
+}
+
+type MappedSLDeviation struct {
+	ImportanceLevel int
+	Consequence     string
+	Message         string
+}
+
+type MappedSLStopDeviation struct {
+	Id              int
+	ImportanceLevel int
+	Message         string
+	// from the deviation's scope, see mapStopDeviations
+	Lines []string
 }
 
 type MappedSLSite struct {
 	Id    int
 	Name  string
 	Alias []string
+	// 0, 0 is left out of the nearby grid
+	Lat float64
+	Lon float64
 }
 
 // Types from the SL API Response
@@ -48,7 +109,13 @@ type SLApiDeparture struct {
 	StopArea      SLApiStopArea         `json:"stop_area"`
 	StopPoint     SLApiStopPoint        `json:"stop_point"`
 	Line          SLApiLine             `json:"line"`
-	Deviations    []interface{}         `json:"deviations"`
+	Deviations    []SLApiDeviation      `json:"deviations"`
+}
+
+type SLApiDeviation struct {
+	ImportanceLevel int    `json:"importance_level"`
+	Consequence     string `json:"consequence"`
+	Message         string `json:"message"`
 }
 
 type SLApiDepartureJourney struct {
@@ -0,0 +1,94 @@
+package sl_api
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	// the location is embedded so we don't depend on tzdata being
+	// installed where we run
+	_ "time/tzdata"
+)
+
+// sl sends local times without any offset
+const slTimeLayout = "2006-01-02T15:04:05"
+
+var stockholm = mustLoadLocation("Europe/Stockholm")
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(fmt.Sprintf("could not load location %s, %v", name, err))
+	}
+	return location
+}
+
+// parseSLTime returns nil for a missing time, and nil and an error for
+// one we can't parse
+func parseSLTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	parsed, err := time.ParseInLocation(slTimeLayout, value, stockholm)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse time %q, %w", value, err)
+	}
+	return &parsed, nil
+}
+
+// parseDepartureTimes sets Scheduled, Expected and DelaySeconds. A time
+// that can't be parsed is left as nil (null in the json) and logged,
+// rather than showing up as year 1 or a delay of 2025 years
+func parseDepartureTimes(mapped *MappedSLDeparture, d SLApiDeparture) {
+	scheduled, err := parseSLTime(d.Scheduled)
+	if err != nil {
+		log.Printf("scheduled time for journey %d, %v", d.Journey.ID, err)
+	}
+	expected, err := parseSLTime(d.Expected)
+	if err != nil {
+		log.Printf("expected time for journey %d, %v", d.Journey.ID, err)
+	}
+
+	mapped.Scheduled = scheduled
+	mapped.Expected = expected
+
+	if scheduled != nil && expected != nil {
+		delay := int(expected.Sub(*scheduled).Seconds())
+		mapped.DelaySeconds = &delay
+	}
+}
+
+// withCountdown returns copies of departures with SecondsUntilDeparture
+// counted from now. Done on every call instead of when mapping since
+// the departures can sit in the cache for a while, and on copies since
+// the cached slice is shared between requests
+func withCountdown(departures []MappedSLDeparture, now time.Time) []MappedSLDeparture {
+	counted := make([]MappedSLDeparture, len(departures))
+
+	for i, d := range departures {
+		if departs := departsAt(d); departs != nil {
+			seconds := int(departs.Sub(now).Seconds())
+			d.SecondsUntilDeparture = &seconds
+		}
+		counted[i] = d
+	}
+
+	return counted
+}
+
+// Recount counts departures from an earlier GetDepartures down again
+// from now and applies the time window and limit of args to them. Only
+// the departures that were in the window back then can be in it now
+func Recount(departures []MappedSLDeparture, args GetDeparturesArgs, now time.Time) []MappedSLDeparture {
+	return limitDepartures(withCountdown(departures, now), args)
+}
+
+// departsAt is the expected time, or the scheduled time when sl has no
+// expectation, nil when we know neither
+func departsAt(d MappedSLDeparture) *time.Time {
+	if d.Expected != nil {
+		return d.Expected
+	}
+	return d.Scheduled
+}
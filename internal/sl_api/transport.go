@@ -0,0 +1,98 @@
+package sl_api
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// the transport modes sl knows about, TransportEmpty means all of them
+type TransportType string
+
+const (
+	TransportBus   TransportType = "BUS"
+	TransportTram  TransportType = "TRAM"
+	TransportMetro TransportType = "METRO"
+	TransportTrain TransportType = "TRAIN"
+	TransportFerry TransportType = "FERRY"
+	TransportShip  TransportType = "SHIP"
+	TransportTaxi  TransportType = "TAXI"
+	TransportEmpty TransportType = ""
+)
+
+func isValidTransportType(t TransportType) bool {
+	switch t {
+	case TransportBus, TransportTram, TransportMetro, TransportTrain,
+		TransportFerry, TransportShip, TransportTaxi, TransportEmpty:
+		return true
+	default:
+		return false
+	}
+}
+
+// what people call the transport modes, in english and swedish. Keys are
+// folded, see foldName
+var transportAliases = map[string]TransportType{
+	"bus":         TransportBus,
+	"buss":        TransportBus,
+	"tram":        TransportTram,
+	"sparvagn":    TransportTram,
+	"lokalbana":   TransportTram,
+	"metro":       TransportMetro,
+	"subway":      TransportMetro,
+	"tunnelbana":  TransportMetro,
+	"t-bana":      TransportMetro,
+	"train":       TransportTrain,
+	"tag":         TransportTrain,
+	"pendeltag":   TransportTrain,
+	"ferry":       TransportFerry,
+	"farja":       TransportFerry,
+	"boat":        TransportFerry,
+	"bat":         TransportFerry,
+	"pendelbat":   TransportFerry,
+	"ship":        TransportShip,
+	"fartyg":      TransportShip,
+	"taxi":        TransportTaxi,
+	"anropsstyrd": TransportTaxi,
+}
+
+// ParseTransportType accepts the sl names ("METRO") as well as aliases
+// like "tunnelbana" or "Pendeltåg", ignoring case and diacritics
+func ParseTransportType(value string) (TransportType, error) {
+	folded := foldName(strings.TrimSpace(value))
+	if folded == "" {
+		return TransportEmpty, nil
+	}
+
+	if t, found := transportAliases[folded]; found {
+		return t, nil
+	}
+
+	return TransportEmpty, fmt.Errorf("could not parse transport %s, %w", value, ErrInvalidTransportType)
+}
+
+var diacritics = strings.NewReplacer(
+	"å", "a", "ä", "a", "á", "a", "à", "a", "â", "a",
+	"ö", "o", "ó", "o", "ø", "o",
+	"é", "e", "è", "e", "ë", "e", "ê", "e",
+	"ü", "u", "ú", "u",
+	"í", "i", "ï", "i",
+)
+
+// foldName lower cases and strips the diacritics we see in swedish
+// names, so "Pendeltåg" and "pendeltag" compare equal. Diacritics
+// written as a letter followed by a combining mark (what some keyboards
+// and copy pastes give) lose the mark, the replacer only knows the
+// letters with the diacritic built in
+func foldName(value string) string {
+	return diacritics.Replace(strings.ToLower(stripMarks(value)))
+}
+
+func stripMarks(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, value)
+}
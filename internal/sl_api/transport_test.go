@@ -0,0 +1,39 @@
+package sl_api_test
+
+import (
+	"testing"
+
+	"github.com/alexdriaguine/go-sl-time-table/internal/sl_api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTransportType(t *testing.T) {
+	t.Run("accepts sl names and aliases regardless of case and diacritics", func(t *testing.T) {
+		cases := map[string]sl_api.TransportType{
+			"":           sl_api.TransportEmpty,
+			"BUS":        sl_api.TransportBus,
+			"buss":       sl_api.TransportBus,
+			"Spårvagn":   sl_api.TransportTram,
+			"tunnelbana": sl_api.TransportMetro,
+			"T-bana":     sl_api.TransportMetro,
+			"pendeltåg":  sl_api.TransportTrain,
+			"PENDELTAG":  sl_api.TransportTrain,
+			"färja":      sl_api.TransportFerry,
+			"pendelbåt":  sl_api.TransportFerry,
+			"ship":       sl_api.TransportShip,
+			" taxi ":     sl_api.TransportTaxi,
+		}
+
+		for value, want := range cases {
+			got, err := sl_api.ParseTransportType(value)
+			require.NoError(t, err, value)
+			assert.Equal(t, want, got, value)
+		}
+	})
+
+	t.Run("unknown transport returns error", func(t *testing.T) {
+		_, err := sl_api.ParseTransportType("rocket")
+		assert.ErrorIs(t, err, sl_api.ErrInvalidTransportType)
+	})
+}